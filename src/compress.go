@@ -0,0 +1,279 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+)
+
+const (
+	contentEncodingHeader = "Content-Encoding"
+	// compressedDirName holds compressed copies of local files, in the
+	// efmrl's state directory, named by the MD5 of the uncompressed file
+	compressedDirName = "compressed"
+	// defaultCompressMinSize is the smallest file compressed, unless the
+	// config says otherwise; below it, compression rarely pays.
+	defaultCompressMinSize = 1 << 10
+)
+
+// encoders are the supported Content-Encodings. Output must only depend on
+// the input, so that compressed files keep the same ETag between syncs.
+var encoders = map[string]func(io.Writer) (io.WriteCloser, error){
+	"gzip": func(w io.Writer) (io.WriteCloser, error) {
+		// a zero header has no name or time, so output is repeatable
+		return gzip.NewWriterLevel(w, gzip.BestCompression)
+	},
+	"br": func(w io.Writer) (io.WriteCloser, error) {
+		return brotli.NewWriterLevel(w, brotli.BestCompression), nil
+	},
+}
+
+// decoders undo the encoders, for files that are pulled
+var decoders = map[string]func(io.Reader) (io.Reader, error){
+	"gzip": func(r io.Reader) (io.Reader, error) {
+		return gzip.NewReader(r)
+	},
+	"br": func(r io.Reader) (io.Reader, error) {
+		return brotli.NewReader(r), nil
+	},
+}
+
+// compressibleTypes are compressed by default, along with text/* and any
+// "+json" or "+xml" type
+var compressibleTypes = map[string]bool{
+	"application/javascript":    true,
+	"application/json":          true,
+	"application/manifest+json": true,
+	"application/wasm":          true,
+	"application/xml":           true,
+	"image/svg+xml":             true,
+	"image/x-icon":              true,
+	"font/otf":                  true,
+	"font/ttf":                  true,
+}
+
+// compressConfig turns on compressing files before they are pushed. Files
+// are compressed if they match Match, or, if Match is empty, if their
+// content type is compressible; either way, not if they match Exclude or
+// are smaller than MinSize. Globs use the same syntax as .efmrlignore.
+type compressConfig struct {
+	Encoding string   `json:"encoding"` // "gzip" or "br"
+	Match    []string `json:"match,omitempty"`
+	Exclude  []string `json:"exclude,omitempty"`
+	MinSize  byteSize `json:"min_size,omitempty"`
+
+	match   []*ignorePattern
+	exclude []*ignorePattern
+}
+
+// compile checks the encoding and compiles the globs
+func (cc *compressConfig) compile() error {
+	if encoders[cc.Encoding] == nil {
+		return fmt.Errorf("unknown compression encoding %q", cc.Encoding)
+	}
+
+	compile := func(globs []string) ([]*ignorePattern, error) {
+		var pats []*ignorePattern
+		for _, glob := range globs {
+			pat, err := compileIgnorePattern(glob)
+			if err != nil {
+				return nil, fmt.Errorf("bad compress glob %q: %w", glob, err)
+			}
+			if pat == nil || pat.negate {
+				return nil, fmt.Errorf("bad compress glob %q: empty or negated", glob)
+			}
+			pats = append(pats, pat)
+		}
+		return pats, nil
+	}
+
+	var err error
+	cc.match, err = compile(cc.Match)
+	if err != nil {
+		return err
+	}
+	cc.exclude, err = compile(cc.Exclude)
+
+	return err
+}
+
+// eligible reports whether the file at rel, relative to the efmrl, is
+// compressed
+func (cc *compressConfig) eligible(
+	rel string,
+	contentType string,
+	size int64,
+) bool {
+	minSize := int64(cc.MinSize)
+	if minSize == 0 {
+		minSize = defaultCompressMinSize
+	}
+	if size < minSize {
+		return false
+	}
+
+	rel = strings.Trim(filepath.ToSlash(rel), "/")
+	for _, pat := range cc.exclude {
+		if pat.matchesPath(rel) {
+			return false
+		}
+	}
+	if len(cc.match) > 0 {
+		for _, pat := range cc.match {
+			if pat.matchesPath(rel) {
+				return true
+			}
+		}
+		return false
+	}
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	return strings.HasPrefix(mediaType, "text/") ||
+		strings.HasSuffix(mediaType, "+json") ||
+		strings.HasSuffix(mediaType, "+xml") ||
+		compressibleTypes[mediaType]
+}
+
+// compressor keeps compressed copies of local files in the state directory,
+// so that they are only compressed once, and their ETags are cached like
+// any other file's.
+type compressor struct {
+	cc     *compressConfig
+	dir    string
+	hashes *hashCache
+
+	mu   sync.Mutex
+	used map[string]bool // compressed files used by this sync
+}
+
+func newCompressor(cfg *Config, hashes *hashCache) (*compressor, error) {
+	stateDir, err := cfg.stateDir()
+	if err != nil {
+		return nil, err
+	}
+
+	return &compressor{
+		cc:     cfg.Compress,
+		dir:    filepath.Join(stateDir, compressedDirName, cfg.Compress.Encoding),
+		hashes: hashes,
+		used:   map[string]bool{},
+	}, nil
+}
+
+// compress points item's body at a compressed copy, and adds
+// Content-Encoding to headers, if the item is eligible. Items that are not
+// under RootDir are left alone.
+func (c *compressor) compress(
+	cfg *Config,
+	item *workItem,
+	contentType string,
+	headers http.Header,
+) error {
+	if c == nil || item.remotePath != "" {
+		return nil
+	}
+	if !c.cc.eligible(item.rel(cfg), contentType, item.info.Size()) {
+		return nil
+	}
+
+	sum, err := c.hashes.etag(item.path, item.info, 0)
+	if err != nil {
+		return err
+	}
+	cpath := filepath.Join(c.dir, sum[:2], sum)
+
+	c.mu.Lock()
+	c.used[cpath] = true
+	c.mu.Unlock()
+
+	info, err := os.Stat(cpath)
+	if err != nil {
+		err = c.write(item.path, cpath)
+		if err != nil {
+			return fmt.Errorf("cannot compress %q: %w", item.path, err)
+		}
+		info, err = os.Stat(cpath)
+		if err != nil {
+			return err
+		}
+	}
+
+	item.body = cpath
+	item.bodyInfo = info
+	headers.Set(contentEncodingHeader, c.cc.Encoding)
+
+	return nil
+}
+
+// write compresses src into dst
+func (c *compressor) write(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	err = os.MkdirAll(filepath.Dir(dst), 0700)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(dst), filepath.Base(dst)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	w, err := encoders[c.cc.Encoding](tmp)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	_, err = io.Copy(w, in)
+	if err == nil {
+		err = w.Close()
+	}
+	if closeErr := tmp.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), dst)
+}
+
+// prune removes compressed files that this sync didn't use
+func (c *compressor) prune() error {
+	if c == nil {
+		return nil
+	}
+
+	err := filepath.WalkDir(c.dir, func(
+		path string,
+		d fs.DirEntry,
+		err error,
+	) error {
+		if err != nil || d.IsDir() || c.used[path] {
+			return err
+		}
+		return os.Remove(path)
+	})
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	return err
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompress(t *testing.T) {
+	t.Run("eligible", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		cc := &compressConfig{Encoding: "gzip", Exclude: []string{"vendor/"}}
+		require.NoError(cc.compile())
+
+		vectors := []struct {
+			rel         string
+			contentType string
+			size        int64
+			want        bool
+		}{
+			{"app.js", "text/javascript; charset=utf-8", 5000, true},
+			{"data.json", "application/json", 5000, true},
+			{"feed.atom", "application/atom+xml", 5000, true},
+			{"logo.svg", "image/svg+xml", 5000, true},
+			{"photo.jpg", "image/jpeg", 5000, false},
+			{"site.zip", "application/zip", 5000, false},
+			{"tiny.css", "text/css; charset=utf-8", 10, false},
+			{"vendor/lib.js", "text/javascript; charset=utf-8", 5000, false},
+		}
+		for _, v := range vectors {
+			assert.Equalf(v.want, cc.eligible(v.rel, v.contentType, v.size), "%q", v.rel)
+		}
+
+		cc = &compressConfig{Encoding: "gzip", Match: []string{"*.wasm", "*.bin"}}
+		require.NoError(cc.compile())
+		assert.True(cc.eligible("a/b.bin", "application/octet-stream", 5000))
+		assert.False(cc.eligible("app.js", "text/javascript", 5000))
+
+		assert.Error((&compressConfig{Encoding: "zstd"}).compile())
+		assert.NoError((&compressConfig{Encoding: "br"}).compile())
+	})
+
+	t.Run("sync", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		goBack, err := cdTmp(t)
+		require.NoError(err)
+		defer goBack()
+		cleanup, err := fakeHome(t)
+		require.NoError(err)
+		defer cleanup()
+
+		bundle := strings.Repeat("console.log('hello');\n", 200)
+		writeTree(t, "site", map[string]string{
+			"js/bundle.js": bundle,
+			"img/pic.png":  strings.Repeat("\x89PNG", 500),
+		})
+
+		fe, ts := newFakeEfmrl(nil)
+		defer ts.Close()
+		newConfig := func(ts *httptest.Server) *Config {
+			cfg := &Config{
+				Efmrl:    "squeeze",
+				CanonURL: ts.URL,
+				RootDir:  "site",
+				Compress: &compressConfig{Encoding: "gzip"},
+				ts:       ts,
+			}
+			require.NoError(cfg.Compress.compile())
+			require.NoError(cfg.prep())
+			return cfg
+		}
+
+		ctx := &CLIContext{Quiet: true}
+		sync := &SyncCmd{Parallel: 2, ts: ts}
+		require.NoError(sync.sync(ctx, newConfig(ts)))
+
+		assert.Equal("gzip", fe.headers["/js/bundle.js"].Get(contentEncodingHeader))
+		zr, err := gzip.NewReader(bytes.NewReader([]byte(fe.files["/js/bundle.js"])))
+		require.NoError(err)
+		got, err := io.ReadAll(zr)
+		require.NoError(err)
+		assert.Equal(bundle, string(got))
+		assert.Less(len(fe.files["/js/bundle.js"]), len(bundle))
+
+		assert.Empty(fe.headers["/img/pic.png"].Get(contentEncodingHeader))
+
+		// the compressed ETag matches, so nothing is pushed again
+		fe.log = nil
+		sync = &SyncCmd{Parallel: 2, ts: ts}
+		require.NoError(sync.sync(ctx, newConfig(ts)))
+		assert.Empty(fe.log)
+
+		// brotli keeps compressed copies of its own
+		br := func(ts *httptest.Server) *Config {
+			cfg := newConfig(ts)
+			cfg.Compress = &compressConfig{Encoding: "br"}
+			require.NoError(cfg.Compress.compile())
+			return cfg
+		}
+		sync = &SyncCmd{Parallel: 2, ts: ts}
+		require.NoError(sync.sync(ctx, br(ts)))
+		assert.Equal("br", fe.headers["/js/bundle.js"].Get(contentEncodingHeader))
+		got, err = io.ReadAll(brotli.NewReader(strings.NewReader(fe.files["/js/bundle.js"])))
+		require.NoError(err)
+		assert.Equal(bundle, string(got))
+
+		fe.log = nil
+		sync = &SyncCmd{Parallel: 2, ts: ts}
+		require.NoError(sync.sync(ctx, br(ts)))
+		assert.Empty(fe.log)
+	})
+}
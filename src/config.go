@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"encoding/json"
 	"fmt"
@@ -17,6 +18,7 @@ import (
 
 	"github.com/efmrl/api2"
 
+	"efmrl.com/efmrl/cli/efmrlclient"
 	"golang.org/x/net/publicsuffix"
 )
 
@@ -80,6 +82,39 @@ type Config struct {
 
 	RootDir string `json:"root_dir"`
 
+	// Ignore lists gitignore-style patterns, relative to RootDir, for files
+	// that should not be synced. .efmrlignore files under RootDir add to it.
+	Ignore []string `json:"ignore,omitempty"`
+	ignore *ignorer // compiled from Ignore and the .efmrlignore files
+
+	// DeployHistory is how many of the latest deploys keep a local copy of
+	// every file they deployed, so that they can be rolled back. Every deploy
+	// is recorded, but the copies take space, so none are kept unless this
+	// is set.
+	DeployHistory int `json:"deploy_history,omitempty"`
+
+	// Headers are rules for extra headers, such as Cache-Control, to push
+	// files with
+	Headers []*headerRule `json:"headers,omitempty"`
+
+	// Compress, if set, compresses files before they are pushed
+	Compress *compressConfig `json:"compress,omitempty"`
+
+	// Retry, if set, changes how failed requests are retried
+	Retry *retryConfig `json:"retry,omitempty"`
+
+	// Hooks, if set, are commands that sync runs, e.g. to build the site
+	Hooks *hooksConfig `json:"hooks,omitempty"`
+
+	// Mounts are other local directories to sync, each to its own part of
+	// the efmrl
+	Mounts []*mountConfig `json:"mounts,omitempty"`
+	// prefix is where RootDir goes in the efmrl; set only in the Configs
+	// that mounts returns
+	prefix string
+	// nested are the mount directories under RootDir, which its walk skips
+	nested map[string]bool
+
 	// canonURL is a parsed version of CanonURL
 	canonURL *url.URL
 
@@ -191,6 +226,21 @@ func loadConfigTS(ts *httptest.Server) (*Config, error) {
 		cfg.indexNoRewrite[index] = true
 	}
 
+	err = cfg.compileHeaderRules()
+	if err != nil {
+		return nil, err
+	}
+	err = cfg.checkMounts()
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Compress != nil {
+		err = cfg.Compress.compile()
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	return cfg, nil
 }
 
@@ -201,6 +251,7 @@ func (cfg *Config) prep() error {
 		err = fmt.Errorf("cannot parse url %q: %w", cfg.CanonURL, err)
 		return err
 	}
+	cfg.nested = cfg.nestedMounts(cfg.RootDir)
 
 	return nil
 }
@@ -242,7 +293,8 @@ func (cfg *Config) save() error {
 
 func (cfg *Config) migrate() error {
 	if cfg.Version < versionCanonURL {
-		if err := cfg.getCanonURL(); err != nil {
+		// loading the config isn't tied to a command's context
+		if err := cfg.getCanonURL(context.Background()); err != nil {
 			return err
 		}
 		cfg.Version = versionCanonURL
@@ -251,15 +303,21 @@ func (cfg *Config) migrate() error {
 	return nil
 }
 
-func (cfg *Config) getCanonURL() error {
+// getCanonURL asks the efmrl for its canonical URL. It doesn't depend on the
+// CanonURL being there, so it is used when setting up a new project, when
+// changing efmrls, or when migrating; or, any other time you need to set
+// CanonURL.
+func (cfg *Config) getCanonURL(ctx context.Context) error {
 	client, err := cfg.getClient()
 	if err != nil {
 		return err
 	}
 
-	url := cfg.pathToMDURL()
-	md := &api2.GetEfmrlMDRes{}
-	err = getJSON(client, url, api2.NewResult(md))
+	base := &url.URL{
+		Scheme: "https",
+		Host:   cfg.hostPart(),
+	}
+	md, err := efmrlclient.New(base, client).Metadata(ctx)
 	if err != nil {
 		return err
 	}
@@ -463,28 +521,6 @@ func (cfg *Config) hostPart() string {
 	return fmt.Sprintf("%v.%v", cfg.Efmrl, baseHost)
 }
 
-// pathToMDURL is special, because it doesn't depend on the CanonURL to be
-// there. It is used when setting up a new project, when changing efmrls, or
-// when migrating; or, any other time you need to set CanonURL.
-func (cfg *Config) pathToMDURL() *url.URL {
-	url := &url.URL{
-		Scheme: "https",
-		Host:   cfg.hostPart(),
-		Path:   filepath.Join(api2.DefaultAPIPrefix, "rest", "md"),
-	}
-
-	return url
-}
-
-func (cfg *Config) pathToAPIurl(path string) *url.URL {
-	url := &url.URL{}
-	*url = *cfg.canonURL
-
-	url.Path = filepath.Join(api2.DefaultAPIPrefix, "rest", path)
-
-	return url
-}
-
 func (cfg *Config) pathToAdminURL(path string) *url.URL {
 	url := &url.URL{}
 	*url = *cfg.canonURL
@@ -503,7 +539,7 @@ func (cfg *Config) pathToURL(prefix, path string) *url.URL {
 	}
 
 	if prefix != "" {
-		path = filepath.Join(prefix, path)
+		path = filepath.ToSlash(filepath.Join(prefix, path))
 	}
 
 	u := &url.URL{}
@@ -567,15 +603,39 @@ func (cfg *Config) getClient() (*http.Client, error) {
 	}
 
 	return &http.Client{
-		Transport: &http.Transport{
-			TLSClientConfig: &tls.Config{
-				InsecureSkipVerify: cfg.Insecure,
+		Transport: &retryTransport{
+			next: &loggingTransport{
+				next: &http.Transport{
+					TLSClientConfig: &tls.Config{
+						InsecureSkipVerify: cfg.Insecure,
+					},
+				},
 			},
+			policy: cfg.retryPolicy(),
 		},
 		Jar: jar,
 	}, nil
 }
 
+// apiClient returns a client for the efmrl's REST API, with the user's
+// login cookies
+func (cfg *Config) apiClient() (*efmrlclient.Client, error) {
+	client, err := cfg.getClient()
+	if err != nil {
+		return nil, err
+	}
+
+	base := cfg.canonURL
+	if base == nil {
+		base = &url.URL{
+			Scheme: "https",
+			Host:   cfg.hostPart(),
+		}
+	}
+
+	return efmrlclient.New(base, client), nil
+}
+
 func getJar(cfg *Config) (*cookiejar.Jar, error) {
 	options := &cookiejar.Options{
 		PublicSuffixList: publicsuffix.List,
@@ -642,6 +702,20 @@ If you do not want to rewrite %q, do this:
 	return
 }
 
+// ignored reports whether rel, a path relative to RootDir, is excluded from
+// syncing by the ignore list or an .efmrlignore file.
+func (cfg *Config) ignored(rel string, isDir bool) (bool, error) {
+	if cfg.ignore == nil {
+		var err error
+		cfg.ignore, err = newIgnorer(cfg.RootDir, cfg.Ignore)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	return cfg.ignore.ignored(filepath.ToSlash(rel), isDir)
+}
+
 // contentType tries to determine the mime type for the given path
 // It uses the file extension if there is one. Otherwise, it reads the first
 // contentTypeBytes bytes to determine the type.
@@ -675,8 +749,14 @@ func (cfg *Config) contentType(path string) (string, error) {
 }
 
 func (cfg *Config) getTestClient(jar *cookiejar.Jar) (*http.Client, error) {
-	client := cfg.ts.Client()
+	// ts.Client() is shared, so change a copy
+	client := &http.Client{}
+	*client = *cfg.ts.Client()
 	client.Jar = jar
+	client.Transport = &retryTransport{
+		next:   &loggingTransport{next: client.Transport},
+		policy: cfg.retryPolicy(),
+	}
 
 	return client, nil
 }
@@ -692,6 +772,28 @@ func globalPath() (string, error) {
 	return filepath.Join(home, globalConfigName), nil
 }
 
+// stateDir returns the directory under the global config directory where
+// per-efmrl local state (cached hashes and the like) is kept. CanonURL must
+// be set.
+func (cfg *Config) stateDir() (string, error) {
+	if cfg.CanonURL == "" {
+		return "", fmt.Errorf("efmrl URL is not set")
+	}
+	if cfg.canonURL == nil {
+		if err := cfg.prep(); err != nil {
+			return "", err
+		}
+	}
+
+	fpath, err := globalPath()
+	if err != nil {
+		return "", err
+	}
+	host := strings.ReplaceAll(cfg.canonURL.Host, ":", "_")
+
+	return filepath.Join(filepath.Dir(fpath), "efmrls", host), nil
+}
+
 func homeDir() (string, error) {
 	home := os.Getenv("HOME")
 	if home != "" {
@@ -170,6 +170,32 @@ func TestConfig(t *testing.T) {
 		assert.Equal(cfg, cfg2)
 	})
 
+	t.Run("compress settings survive a save", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		goBack, err := cdTmp(t)
+		require.NoError(err)
+		defer goBack()
+
+		cfg := &Config{
+			Version:  currentVersion,
+			Efmrl:    "monkey-willard",
+			Compress: &compressConfig{Encoding: "gzip"},
+		}
+		require.NoError(cfg.Compress.MinSize.UnmarshalText([]byte("4KB")))
+		require.NoError(cfg.save())
+		cfgBytes, err := os.ReadFile(configName)
+		require.NoError(err)
+		assert.Contains(string(cfgBytes), `"min_size": "4KiB"`)
+
+		cfg, err = loadConfig()
+		require.NoError(err)
+		assert.Equal(byteSize(4<<10), cfg.Compress.MinSize)
+		require.NoError(cfg.save())
+		_, err = loadConfig()
+		assert.NoError(err)
+	})
 	t.Run("global config works", func(t *testing.T) {
 		assert := assert.New(t)
 		require := require.New(t)
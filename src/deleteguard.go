@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+)
+
+const (
+	// defaultMaxDelete is how many files "sync -D" deletes without --yes
+	defaultMaxDelete = 100
+	// maxDeletePercent is how much of the efmrl, in percent of its files,
+	// "sync -D" deletes without --yes
+	maxDeletePercent = 50
+	// deleteGuardMinFiles is how many deletes are allowed however small
+	// the efmrl, since deleting 2 of 3 files is no cause for alarm
+	deleteGuardMinFiles = 10
+)
+
+// guardDeletes refuses to delete what looks like too much of the efmrl,
+// as when RootDir is wrong or a build left it empty, unless --yes or a high
+// enough --max-delete is given. If no local files were found at all, only
+// --yes will do. When it refuses, it shows what would have been deleted.
+func (s *SyncCmd) guardDeletes(ctx *CLIContext, cfg *Config, seen seenMap) error {
+	if s.Yes || s.DryRun {
+		return nil
+	}
+	stale, err := staleFiles(cfg, seen)
+	if err != nil {
+		return err
+	}
+	n := len(stale)
+	if n == 0 {
+		return nil
+	}
+
+	var why string
+	override := "--yes or --max-delete"
+	switch {
+	case s.changed == nil && s.progress.files.Load() == 0:
+		why = "no local files were found"
+		override = "--yes"
+	case s.MaxDelete > 0:
+		if n > s.MaxDelete {
+			why = fmt.Sprintf("that is more than --max-delete %v", s.MaxDelete)
+		}
+	case n > defaultMaxDelete:
+		why = fmt.Sprintf("that is more than %v", defaultMaxDelete)
+	case n >= deleteGuardMinFiles && n*100 > s.remoteFiles*maxDeletePercent:
+		why = fmt.Sprintf("that is most of the %v files in the efmrl", s.remoteFiles)
+	}
+	if why == "" {
+		return nil
+	}
+
+	cfgCopy := *cfg
+	cfgCopy.skipLen = 0
+	if !ctx.isJSON() {
+		fmt.Fprintf(ctx.chatter(), "would delete %v files:\n", n)
+	}
+	for _, fname := range stale {
+		if ctx.isJSON() {
+			ctx.event(&fileEvent{
+				Action: eventDelete,
+				Path:   efmrlPath(fname),
+				URL:    cfgCopy.pathToURL("", fname).String(),
+				DryRun: true,
+			})
+			continue
+		}
+		fmt.Fprintf(ctx.chatter(), "    %v\n", efmrlPath(fname))
+	}
+
+	return fmt.Errorf(
+		"not deleting %v files, since %v; check the root directory %q, or use %v",
+		n,
+		why,
+		cfg.RootDir,
+		override,
+	)
+}
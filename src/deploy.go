@@ -0,0 +1,561 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/efmrl/api2"
+)
+
+const (
+	// deploysDirName holds one manifest per deploy, in the efmrl's state
+	// directory. The server has no place to keep them yet.
+	deploysDirName = "deploys"
+	// objectsDirName holds a copy of every deployed file, named by MD5, so
+	// that old deploys can be restored.
+	objectsDirName = "objects"
+	// deployIDFormat is used to name deploys by their start time
+	deployIDFormat = "20060102-150405"
+	// deploysKept is how many manifests are kept, or DeployHistory if that
+	// is more. Only the latest DeployHistory keep copies of their files.
+	deploysKept = 100
+)
+
+// deployManifest records one sync: every file the efmrl should have
+// afterwards, and what was deleted.
+type deployManifest struct {
+	ID         string    `json:"id"`
+	Time       time.Time `json:"time"`
+	User       string    `json:"user,omitempty"`
+	Complete   bool      `json:"complete"`
+	RollbackOf string    `json:"rollback_of,omitempty"`
+	// DeleteOthers is set if the sync deleted what it didn't push, so that
+	// Files is everything the efmrl had
+	DeleteOthers bool          `json:"delete_others,omitempty"`
+	Files        []*deployFile `json:"files"`
+	Deleted      []string      `json:"deleted,omitempty"`
+}
+
+// deployFile is one file in a deploy
+type deployFile struct {
+	Path        string `json:"path"` // in the efmrl
+	MD5         string `json:"md5"`
+	Size        int64  `json:"size"`
+	ContentType string `json:"content_type,omitempty"`
+	Pushed      bool   `json:"pushed,omitempty"`
+
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+// deployRecorder collects a deploy manifest while syncing, and if the
+// config keeps deploy history, a copy of each file's contents. A nil
+// *deployRecorder records nothing.
+type deployRecorder struct {
+	dir    string // the efmrl's state directory
+	hashes *hashCache
+	copies int // how many deploys keep copies of their files
+
+	mu       sync.Mutex
+	manifest *deployManifest
+}
+
+func newDeployRecorder(
+	ctx context.Context,
+	cfg *Config,
+	hashes *hashCache,
+) (*deployRecorder, error) {
+	dir, err := cfg.stateDir()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	dr := &deployRecorder{
+		dir:    dir,
+		hashes: hashes,
+		copies: cfg.DeployHistory,
+		manifest: &deployManifest{
+			ID:   now.Format(deployIDFormat),
+			Time: now,
+		},
+	}
+
+	// who did it is nice to know, but not worth failing over
+	if ses, err := getSession(ctx, cfg); err == nil {
+		dr.manifest.User = ses.UserKey
+		if dr.manifest.User == "" {
+			dr.manifest.User = ses.UserID
+		}
+	}
+
+	return dr, nil
+}
+
+// add records that the efmrl has the file at localPath as remotePath, and
+// makes sure its contents are kept if deploys keep copies.
+func (dr *deployRecorder) add(
+	localPath string,
+	info os.FileInfo,
+	remotePath string,
+	contentType string,
+	headers http.Header,
+	pushed bool,
+) error {
+	if dr == nil {
+		return nil
+	}
+
+	sum, err := dr.hashes.etag(localPath, info, 0)
+	if err != nil {
+		return err
+	}
+	if dr.copies > 0 {
+		err = dr.store(localPath, sum)
+		if err != nil {
+			return err
+		}
+	}
+
+	df := &deployFile{
+		Path:        remotePath,
+		MD5:         sum,
+		Size:        info.Size(),
+		ContentType: contentType,
+		Pushed:      pushed,
+		Headers:     map[string]string{},
+	}
+	for name := range headers {
+		df.Headers[name] = headers.Get(name)
+	}
+
+	dr.mu.Lock()
+	defer dr.mu.Unlock()
+	dr.manifest.Files = append(dr.manifest.Files, df)
+
+	return nil
+}
+
+// store copies localPath into the object store, if it's not already there
+func (dr *deployRecorder) store(localPath, sum string) error {
+	opath := objectPath(dr.dir, sum)
+	if _, err := os.Stat(opath); err == nil {
+		return nil
+	}
+
+	src, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	err = os.MkdirAll(filepath.Dir(opath), 0700)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(opath), sum+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = io.Copy(tmp, src)
+	if err != nil {
+		tmp.Close()
+		return fmt.Errorf("cannot keep a copy of %q: %w", localPath, err)
+	}
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), opath)
+}
+
+// finish writes the manifest and prunes old deploys. syncErr is the outcome
+// of the sync; the manifest is written either way, since a failed sync may
+// still have changed the efmrl.
+func (dr *deployRecorder) finish(deleted []string, syncErr error) error {
+	if dr == nil {
+		return nil
+	}
+
+	dr.mu.Lock()
+	defer dr.mu.Unlock()
+
+	mf := dr.manifest
+	mf.Complete = syncErr == nil
+	mf.Deleted = deleted
+	sort.Slice(mf.Files, func(i, j int) bool {
+		return mf.Files[i].Path < mf.Files[j].Path
+	})
+
+	// don't let two deploys in the same second collide
+	ddir := filepath.Join(dr.dir, deploysDirName)
+	id := mf.ID
+	for i := 2; ; i++ {
+		if _, err := os.Stat(filepath.Join(ddir, id+".json")); os.IsNotExist(err) {
+			break
+		}
+		id = fmt.Sprintf("%v-%v", mf.ID, i)
+	}
+	mf.ID = id
+
+	mfBytes, err := json.MarshalIndent(mf, "", "    ")
+	if err != nil {
+		return err
+	}
+	err = writeFileAtomic(filepath.Join(ddir, id+".json"), mfBytes, 0600)
+	if err != nil {
+		return fmt.Errorf("cannot save deploy manifest: %w", err)
+	}
+
+	return pruneDeploys(dr.dir, max(deploysKept, dr.copies), dr.copies)
+}
+
+func objectPath(dir, sum string) string {
+	return filepath.Join(dir, objectsDirName, sum[:2], sum)
+}
+
+// loadDeploys returns the saved manifests, oldest first
+func loadDeploys(dir string) ([]*deployManifest, error) {
+	ddir := filepath.Join(dir, deploysDirName)
+	entries, err := os.ReadDir(ddir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var deploys []*deployManifest
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		mfBytes, err := os.ReadFile(filepath.Join(ddir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		mf := &deployManifest{}
+		err = json.Unmarshal(mfBytes, mf)
+		if err != nil {
+			return nil, fmt.Errorf(
+				"cannot parse deploy manifest %q: %w",
+				entry.Name(),
+				err,
+			)
+		}
+		deploys = append(deploys, mf)
+	}
+
+	sort.Slice(deploys, func(i, j int) bool {
+		return deploys[i].Time.Before(deploys[j].Time)
+	})
+
+	return deploys, nil
+}
+
+// pruneDeploys removes all but the newest keep manifests, and any stored
+// objects that the newest copies of them don't use.
+func pruneDeploys(dir string, keep, copies int) error {
+	deploys, err := loadDeploys(dir)
+	if err != nil {
+		return err
+	}
+	if len(deploys) > keep {
+		for _, mf := range deploys[:len(deploys)-keep] {
+			fpath := filepath.Join(dir, deploysDirName, mf.ID+".json")
+			err = os.Remove(fpath)
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		deploys = deploys[len(deploys)-keep:]
+	}
+
+	used := map[string]bool{}
+	for _, mf := range deploys[max(len(deploys)-copies, 0):] {
+		for _, df := range mf.Files {
+			used[df.MD5] = true
+		}
+	}
+
+	odir := filepath.Join(dir, objectsDirName)
+	return filepath.WalkDir(odir, func(
+		path string,
+		d os.DirEntry,
+		err error,
+	) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() || used[d.Name()] {
+			return nil
+		}
+		return os.Remove(path)
+	})
+}
+
+// DeploysCmd holds the deploy history commands
+type DeploysCmd struct {
+	List DeploysList `cmd:"" help:"list recent deploys"`
+}
+
+// DeploysList lists the recorded deploys
+type DeploysList struct {
+	ts *httptest.Server
+}
+
+// Run the "deploys list" subcommand
+func (dl *DeploysList) Run(ctx *CLIContext) error {
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	cfg.ts = dl.ts
+
+	dir, err := cfg.stateDir()
+	if err != nil {
+		return err
+	}
+	deploys, err := loadDeploys(dir)
+	if err != nil {
+		return err
+	}
+
+	var summaries []*deploySummary
+	tbl := &table{}
+	for i := len(deploys) - 1; i >= 0; i-- {
+		mf := deploys[i]
+		sum := &deploySummary{
+			ID:         mf.ID,
+			Time:       mf.Time,
+			User:       mf.User,
+			Complete:   mf.Complete,
+			RollbackOf: mf.RollbackOf,
+			Files:      len(mf.Files),
+			Deleted:    len(mf.Deleted),
+		}
+		for _, df := range mf.Files {
+			if df.Pushed {
+				sum.Pushed++
+			}
+		}
+		summaries = append(summaries, sum)
+
+		var notes []string
+		if !mf.Complete {
+			notes = append(notes, "incomplete")
+		}
+		if !mf.DeleteOthers {
+			notes = append(notes, "without -D")
+		}
+		if mf.RollbackOf != "" {
+			notes = append(notes, "rollback of "+mf.RollbackOf)
+		}
+		if !hasCopies(dir, mf) {
+			notes = append(notes, "no copies to roll back to")
+		}
+		tbl.add(
+			sum.ID,
+			sum.Time.Local().Format(time.DateTime),
+			sum.User,
+			fmt.Sprintf("%v files", sum.Files),
+			fmt.Sprintf("%v pushed", sum.Pushed),
+			fmt.Sprintf("%v deleted", sum.Deleted),
+			strings.Join(notes, ", "),
+		)
+	}
+
+	return ctx.showList(summaries, tbl)
+}
+
+// hasCopies reports whether the object store has every file in mf
+func hasCopies(dir string, mf *deployManifest) bool {
+	for _, df := range mf.Files {
+		if _, err := os.Stat(objectPath(dir, df.MD5)); err != nil {
+			return false
+		}
+	}
+
+	return true
+}
+
+// deploySummary is a deploy as shown by "deploys list"
+type deploySummary struct {
+	ID         string    `json:"id"`
+	Time       time.Time `json:"time"`
+	User       string    `json:"user,omitempty"`
+	Complete   bool      `json:"complete"`
+	RollbackOf string    `json:"rollback_of,omitempty"`
+	Files      int       `json:"files"`
+	Pushed     int       `json:"pushed"`
+	Deleted    int       `json:"deleted"`
+}
+
+// RollbackCmd restores the efmrl to an earlier deploy
+type RollbackCmd struct {
+	ID        string `arg:"" help:"ID of the deploy to restore, from 'deploys list'"`
+	DryRun    bool   `short:"n" help:"show what would change without changing it"`
+	Delete    bool   `short:"D" help:"also delete files that are not in the deploy; only for complete deploys synced with -D"`
+	Yes       bool   `short:"y" help:"with -D, delete however many files are not in the deploy"`
+	MaxDelete int    `help:"with -D, delete up to this many files; by default, more than 100, or most of the efmrl, needs --yes"`
+	CrossFS   bool   `short:"X" help:"cross filesystem mounts within the efmrl"`
+	Parallel  int    `default:"1" short:"p" help:"how many files to upload or delete at once"`
+
+	ts *httptest.Server
+}
+
+// Run the "rollback" subcommand
+func (rb *RollbackCmd) Run(ctx *CLIContext) error {
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	cfg.ts = rb.ts
+	msg, err := loggedIn(ctx.stopContext(), cfg)
+	if err != nil {
+		return err
+	}
+	if msg != "" {
+		fmt.Fprintln(ctx.chatter(), msg)
+		return nil
+	}
+
+	return rb.rollback(ctx, cfg)
+}
+
+func (rb *RollbackCmd) rollback(ctx *CLIContext, cfg *Config) error {
+	dir, err := cfg.stateDir()
+	if err != nil {
+		return err
+	}
+	deploys, err := loadDeploys(dir)
+	if err != nil {
+		return err
+	}
+	var target *deployManifest
+	for _, mf := range deploys {
+		if mf.ID == rb.ID {
+			target = mf
+		}
+	}
+	if target == nil {
+		return fmt.Errorf("no deploy %q; see 'efmrl deploys list'", rb.ID)
+	}
+	// files the manifest doesn't list may be part of the deploy all the same
+	switch {
+	case !rb.Delete:
+	case !target.Complete:
+		return fmt.Errorf("deploy %q is incomplete, so -D could delete files it had; roll back without -D", rb.ID)
+	case !target.DeleteOthers:
+		return fmt.Errorf("deploy %q was synced without -D, so -D could delete files it had; roll back without -D", rb.ID)
+	}
+
+	var missing []string
+	for _, df := range target.Files {
+		if _, err := os.Stat(objectPath(dir, df.MD5)); err != nil {
+			missing = append(missing, df.Path)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf(
+			"cannot restore deploy %q; local copies are missing for %v (deploy_history sets how many deploys keep them)",
+			rb.ID,
+			strings.Join(missing, ", "),
+		)
+	}
+
+	seen := seenMap{}
+	err = setSeenMap(cfg, ctx, seen, 0, rb.CrossFS)
+	if err != nil {
+		return err
+	}
+
+	var recorder *deployRecorder
+	if !rb.DryRun {
+		recorder, err = newDeployRecorder(ctx.stopContext(), cfg, nil)
+		if err != nil {
+			return err
+		}
+	}
+	if recorder != nil {
+		recorder.manifest.RollbackOf = target.ID
+		recorder.manifest.DeleteOthers = rb.Delete
+	}
+
+	// push from the object store, exactly as the deploy had it
+	sync := &SyncCmd{
+		DryRun:      rb.DryRun,
+		Parallel:    rb.Parallel,
+		Yes:         rb.Yes,
+		MaxDelete:   rb.MaxDelete,
+		quiet:       ctx.Quiet,
+		deploy:      recorder,
+		cli:         ctx,
+		progress:    newSyncProgress(),
+		remoteFiles: len(seen),
+	}
+	cfg.skipLen = 0
+	err = sync.pushItems(cfg, "", seen, func(push func(*workItem) error) error {
+		for _, df := range target.Files {
+			opath := objectPath(dir, df.MD5)
+			info, err := os.Stat(opath)
+			if err != nil {
+				return err
+			}
+			headers := http.Header{}
+			for name, value := range df.Headers {
+				headers.Set(name, value)
+			}
+			err = push(&workItem{
+				path:        opath,
+				remotePath:  df.Path,
+				contentType: df.ContentType,
+				headers:     headers,
+				info:        info,
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	var deleted []string
+	if err == nil && rb.Delete {
+		err = sync.guardDeletes(ctx, cfg, seen)
+	}
+	if err == nil && rb.Delete {
+		deleted, err = deleteFromSeenMap(cfg, ctx, seen, rb.DryRun, rb.Parallel, nil)
+	}
+
+	if finishErr := recorder.finish(deleted, err); finishErr != nil && err == nil {
+		err = finishErr
+	}
+
+	return err
+}
+
+// getSession returns the current login session
+func getSession(ctx context.Context, cfg *Config) (*api2.SessionRes, error) {
+	client, err := cfg.apiClient()
+	if err != nil {
+		return nil, err
+	}
+
+	return client.Session(ctx)
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeploys(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	goBack, err := cdTmp(t)
+	require.NoError(err)
+	defer goBack()
+	cleanup, err := fakeHome(t)
+	require.NoError(err)
+	defer cleanup()
+
+	fe, ts := newFakeEfmrl(nil)
+	defer ts.Close()
+	cfg := &Config{
+		Efmrl:         "roll-with-it",
+		CanonURL:      ts.URL,
+		RootDir:       "site",
+		DeployHistory: 3,
+		ts:            ts,
+	}
+	require.NoError(cfg.prep())
+	ctx := &CLIContext{Quiet: true}
+
+	deploy := func() {
+		sync := &SyncCmd{DeleteOthers: true, Parallel: 2, ts: ts}
+		require.NoError(sync.sync(ctx, cfg))
+	}
+
+	writeTree(t, "site", map[string]string{
+		"a.txt": "version one",
+		"b.txt": "bee",
+	})
+	deploy()
+	first := map[string]string{}
+	for fname, contents := range fe.files {
+		first[fname] = contents
+	}
+
+	writeTree(t, "site", map[string]string{
+		"a.txt": "version two",
+		"c.txt": "sea",
+	})
+	require.NoError(os.Remove(filepath.Join("site", "b.txt")))
+	deploy()
+	assert.Equal("version two", fe.files["/a.txt"])
+	assert.NotContains(fe.files, "/b.txt")
+
+	dir, err := cfg.stateDir()
+	require.NoError(err)
+	deploys, err := loadDeploys(dir)
+	require.NoError(err)
+	require.Len(deploys, 2)
+	assert.True(deploys[1].Complete)
+	assert.Equal([]string{"b.txt"}, deploys[1].Deleted)
+
+	// the local files are gone, but the store still has them; files that
+	// aren't in the deploy are only deleted with -D
+	require.NoError(os.RemoveAll("site"))
+	rb := &RollbackCmd{ID: deploys[0].ID, Parallel: 2}
+	require.NoError(rb.rollback(ctx, cfg))
+	assert.Equal("version one", fe.files["/a.txt"])
+	assert.Equal("sea", fe.files["/c.txt"])
+	rb = &RollbackCmd{ID: deploys[0].ID, Delete: true, Parallel: 2}
+	require.NoError(rb.rollback(ctx, cfg))
+	assert.Equal(first, fe.files)
+
+	// rollbacks are deploys too
+	deploys, err = loadDeploys(dir)
+	require.NoError(err)
+	require.Len(deploys, 4)
+	assert.Equal(rb.ID, deploys[3].RollbackOf)
+	assert.True(deploys[3].DeleteOthers)
+
+	rb = &RollbackCmd{ID: "no-such-deploy"}
+	assert.Error(rb.rollback(ctx, cfg))
+
+	// deploys that may not list every file can't be rolled back with -D
+	writeTree(t, "site", map[string]string{"d.txt": "dee"})
+	sync := &SyncCmd{Parallel: 2, ts: ts}
+	require.NoError(sync.sync(ctx, cfg))
+	deploys, err = loadDeploys(dir)
+	require.NoError(err)
+	partial := deploys[len(deploys)-1]
+	assert.False(partial.DeleteOthers)
+	rb = &RollbackCmd{ID: partial.ID, Delete: true, Parallel: 2}
+	assert.ErrorContains(rb.rollback(ctx, cfg), "without -D")
+
+	incomplete := *deploys[0]
+	incomplete.ID += "-incomplete"
+	incomplete.Complete = false
+	mfBytes, err := json.Marshal(&incomplete)
+	require.NoError(err)
+	fpath := filepath.Join(dir, deploysDirName, incomplete.ID+".json")
+	require.NoError(os.WriteFile(fpath, mfBytes, 0600))
+	rb = &RollbackCmd{ID: incomplete.ID, Delete: true, Parallel: 2}
+	assert.ErrorContains(rb.rollback(ctx, cfg), "incomplete")
+	assert.Contains(fe.files, "/d.txt")
+}
+
+func TestDeployHistory(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	goBack, err := cdTmp(t)
+	require.NoError(err)
+	defer goBack()
+	cleanup, err := fakeHome(t)
+	require.NoError(err)
+	defer cleanup()
+
+	_, ts := newFakeEfmrl(nil)
+	defer ts.Close()
+	cfg := &Config{
+		Efmrl:    "no-looking-back",
+		CanonURL: ts.URL,
+		RootDir:  "site",
+		ts:       ts,
+	}
+	require.NoError(cfg.prep())
+	writeTree(t, "site", map[string]string{"a.txt": "a"})
+
+	// every deploy is recorded, but files are only copied if the config
+	// asks, so there is nothing to roll back to
+	ctx := &CLIContext{Quiet: true}
+	sync := &SyncCmd{Parallel: 2, ts: ts}
+	require.NoError(sync.sync(ctx, cfg))
+	writeTree(t, "site", map[string]string{"a.txt": "aa"})
+	sync = &SyncCmd{Parallel: 2, ts: ts}
+	require.NoError(sync.sync(ctx, cfg))
+	dir, err := cfg.stateDir()
+	require.NoError(err)
+	deploys, err := loadDeploys(dir)
+	require.NoError(err)
+	require.Len(deploys, 2)
+	assert.Len(deploys[0].Files, 1)
+	assert.NoDirExists(filepath.Join(dir, objectsDirName))
+	rb := &RollbackCmd{ID: deploys[0].ID, Parallel: 2}
+	assert.ErrorContains(rb.rollback(ctx, cfg), "copies are missing")
+
+	// with history, only the latest deploys keep their copies
+	cfg.DeployHistory = 1
+	for _, contents := range []string{"one", "two"} {
+		writeTree(t, "site", map[string]string{"a.txt": contents})
+		sync = &SyncCmd{Parallel: 2, ts: ts}
+		require.NoError(sync.sync(ctx, cfg))
+	}
+	deploys, err = loadDeploys(dir)
+	require.NoError(err)
+	require.Len(deploys, 4)
+	assert.False(hasCopies(dir, deploys[2]))
+	assert.True(hasCopies(dir, deploys[3]))
+}
@@ -0,0 +1,154 @@
+package efmrlclient
+
+import (
+	"context"
+	"path"
+
+	"github.com/efmrl/api2"
+)
+
+// Metadata returns the efmrl's metadata. Unlike other calls, it works with
+// any of the efmrl's host names as BaseURL.
+func (c *Client) Metadata(ctx context.Context) (*api2.GetEfmrlMDRes, error) {
+	md := &api2.GetEfmrlMDRes{}
+	return md, c.get(ctx, "md", md)
+}
+
+// Session returns the current login session
+func (c *Client) Session(ctx context.Context) (*api2.SessionRes, error) {
+	ses := &api2.SessionRes{}
+	return ses, c.get(ctx, "session", ses)
+}
+
+// PostSession starts or confirms a login
+func (c *Client) PostSession(
+	ctx context.Context,
+	req *api2.SessionReq,
+) (*api2.SessionRes, error) {
+	ses := &api2.SessionRes{}
+	return ses, c.post(ctx, "session", req, ses)
+}
+
+// GetUser returns a user
+func (c *Client) GetUser(ctx context.Context, userID string) (*api2.User, error) {
+	user := &api2.User{}
+	return user, c.get(ctx, path.Join("users", userID), user)
+}
+
+// CreateUser creates a user
+func (c *Client) CreateUser(
+	ctx context.Context,
+	req *api2.PostUserReq,
+) (*api2.User, error) {
+	user := &api2.User{}
+	return user, c.post(ctx, "users", req, user)
+}
+
+// ListUsers returns every user
+func (c *Client) ListUsers(ctx context.Context) (*api2.ListUsersRes, error) {
+	users := &api2.ListUsersRes{}
+	return users, c.get(ctx, "users", users)
+}
+
+// UpdateUser changes the nonzero fields of user
+func (c *Client) UpdateUser(
+	ctx context.Context,
+	userID string,
+	user *api2.User,
+) error {
+	return c.patch(ctx, path.Join("users", userID), user, nil)
+}
+
+// DeleteUser deletes a user
+func (c *Client) DeleteUser(ctx context.Context, userID string) error {
+	return c.del(ctx, path.Join("users", userID))
+}
+
+// AddEmail adds an email address to a user
+func (c *Client) AddEmail(
+	ctx context.Context,
+	userID string,
+	req *api2.PostEmailReq,
+) (*api2.Email, error) {
+	email := &api2.Email{}
+	return email, c.post(ctx, path.Join("users", userID, "emails"), req, email)
+}
+
+// DeleteEmail removes an email address from a user
+func (c *Client) DeleteEmail(ctx context.Context, userID, emailID string) error {
+	return c.del(ctx, path.Join("users", userID, "emails", emailID))
+}
+
+// GetGroup returns a group
+func (c *Client) GetGroup(ctx context.Context, groupID string) (*api2.Group, error) {
+	group := &api2.Group{}
+	return group, c.get(ctx, path.Join("groups", groupID), group)
+}
+
+// CreateGroup creates a group
+func (c *Client) CreateGroup(
+	ctx context.Context,
+	req *api2.PostGroupReq,
+) (*api2.Group, error) {
+	group := &api2.Group{}
+	return group, c.post(ctx, "groups", req, group)
+}
+
+// ListGroups returns every group
+func (c *Client) ListGroups(ctx context.Context) (*api2.GetGroupsRes, error) {
+	groups := &api2.GetGroupsRes{}
+	return groups, c.get(ctx, "groups", groups)
+}
+
+// UpdateGroup changes the nonzero fields of group
+func (c *Client) UpdateGroup(
+	ctx context.Context,
+	groupID string,
+	group *api2.Group,
+) error {
+	return c.patch(ctx, path.Join("groups", groupID), group, nil)
+}
+
+// DeleteGroup deletes a group
+func (c *Client) DeleteGroup(ctx context.Context, groupID string) error {
+	return c.del(ctx, path.Join("groups", groupID))
+}
+
+// ListPerms returns the permissions of the efmrl, its mounts and its users
+func (c *Client) ListPerms(ctx context.Context) (*api2.AllPerms, error) {
+	perms := &api2.AllPerms{}
+	return perms, c.get(ctx, "perms", perms)
+}
+
+// PatchPerms changes users' permissions
+func (c *Client) PatchPerms(ctx context.Context, perms *api2.AllPerms) error {
+	return c.patch(ctx, "perms", perms, nil)
+}
+
+// PatchDataPerms changes the permissions that everyone, sessioned and
+// authenticated visitors have to the efmrl's files
+func (c *Client) PatchDataPerms(ctx context.Context, perms *api2.AllPerms) error {
+	return c.patch(ctx, "perms/data", perms, nil)
+}
+
+// ListNames returns the efmrl's names
+func (c *Client) ListNames(ctx context.Context) (*api2.GetNamesRes, error) {
+	names := &api2.GetNamesRes{}
+	return names, c.get(ctx, "names", names)
+}
+
+// ListFiles returns one page of the efmrl's files. Pass the result's
+// Continuation in the next request to get the next page.
+func (c *Client) ListFiles(
+	ctx context.Context,
+	req *api2.ListFilesReq,
+) (*api2.ListFilesRes, error) {
+	files := &api2.ListFilesRes{}
+	return files, c.query(ctx, "files", req, files)
+}
+
+// DeleteFile deletes a file from the efmrl
+func (c *Client) DeleteFile(ctx context.Context, filePath string) error {
+	_, err := c.Do(ctx, "DELETE", c.FileURL(filePath), nil, nil)
+	return err
+}
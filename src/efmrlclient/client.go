@@ -0,0 +1,201 @@
+// Package efmrlclient calls the REST API of an efmrl. It is what the efmrl
+// command line tool uses, and other Go programs can use it too:
+//
+//	base, _ := url.Parse("https://example.efmrl.net")
+//	client := efmrlclient.New(base, httpClientWithLoginCookies)
+//	users, err := client.ListUsers(ctx)
+//
+// Every method returns an *Error when the server says no, whether by HTTP
+// status or by a JSend status other than "success".
+package efmrlclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+
+	"github.com/efmrl/api2"
+)
+
+// Client calls the API of one efmrl
+type Client struct {
+	// BaseURL is the efmrl's canonical URL, like https://example.efmrl.net
+	BaseURL *url.URL
+	// HTTP makes the requests. Its cookie jar holds the login session.
+	HTTP *http.Client
+}
+
+// New returns a client for the efmrl at baseURL. If httpClient is nil,
+// http.DefaultClient is used, which is only enough for public calls.
+func New(baseURL *url.URL, httpClient *http.Client) *Client {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	return &Client{
+		BaseURL: baseURL,
+		HTTP:    httpClient,
+	}
+}
+
+// Error is a failed call
+type Error struct {
+	Method     string
+	URL        string
+	StatusCode int    // HTTP status code
+	Status     string // JSend status, if the server sent one
+	Message    string // the server's explanation, if it sent one
+}
+
+func (e *Error) Error() string {
+	var why string
+	switch {
+	case e.Message != "":
+		why = e.Message
+	case e.Status != "" && e.Status != api2.StatusSuccess:
+		why = e.Status
+	default:
+		why = http.StatusText(e.StatusCode)
+	}
+
+	return fmt.Sprintf("%v %v: %v (%v)", e.Method, e.URL, why, e.StatusCode)
+}
+
+// IsNotFound reports whether err is an *Error for a 404
+func IsNotFound(err error) bool {
+	var cerr *Error
+	return errors.As(err, &cerr) && cerr.StatusCode == http.StatusNotFound
+}
+
+// APIURL returns the URL of a REST API path, like "users"
+func (c *Client) APIURL(apiPath string) *url.URL {
+	return c.url(path.Join(api2.DefaultAPIPrefix, "rest", apiPath))
+}
+
+// FileURL returns the URL of a file in the efmrl
+func (c *Client) FileURL(filePath string) *url.URL {
+	return c.url(path.Join("/", filePath))
+}
+
+func (c *Client) url(fullPath string) *url.URL {
+	u := &url.URL{}
+	*u = *c.BaseURL
+	u.Path = fullPath
+	u.RawQuery = ""
+
+	return u
+}
+
+// Do sends args, if not nil, as JSON to u, and decodes the JSend response
+// into target, if not nil. The HTTP response is returned with its body
+// already read and closed, for callers that need headers.
+func (c *Client) Do(
+	ctx context.Context,
+	method string,
+	u *url.URL,
+	args any,
+	target any,
+) (*http.Response, error) {
+	return c.do(ctx, method, u, args, target, false)
+}
+
+// do is Do, optionally marking the request as safe to retry, as net/http
+// does with an Idempotency-Key header that has no value: the header is not
+// sent, but transports that retry will see it
+func (c *Client) do(
+	ctx context.Context,
+	method string,
+	u *url.URL,
+	args any,
+	target any,
+	idempotent bool,
+) (*http.Response, error) {
+	var body io.Reader
+	if args != nil {
+		reqBody, err := json.Marshal(args)
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(reqBody)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if args != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if idempotent {
+		req.Header["Idempotency-Key"] = nil
+	}
+
+	res, err := c.HTTP.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	resBody, err := io.ReadAll(res.Body)
+	if err != nil {
+		return res, err
+	}
+
+	cerr := &Error{
+		Method:     method,
+		URL:        u.String(),
+		StatusCode: res.StatusCode,
+	}
+	jres := api2.NewResult(target)
+	decodeErr := json.Unmarshal(resBody, jres)
+	if decodeErr == nil {
+		cerr.Status = jres.Status
+		cerr.Message = jres.Message
+	}
+
+	switch {
+	case res.StatusCode < 200 || res.StatusCode > 299:
+		return res, cerr
+	case target == nil && (decodeErr != nil || jres.Status == ""):
+		// nothing was wanted, and there's no JSend status to check
+		return res, nil
+	case decodeErr != nil:
+		return res, fmt.Errorf("%v %v: cannot decode response: %w", method, u, decodeErr)
+	case jres.Status != api2.StatusSuccess:
+		return res, cerr
+	}
+
+	return res, nil
+}
+
+// get, post, query, patch and del call API paths
+func (c *Client) get(ctx context.Context, apiPath string, target any) error {
+	_, err := c.Do(ctx, "GET", c.APIURL(apiPath), nil, target)
+	return err
+}
+
+func (c *Client) post(ctx context.Context, apiPath string, args, target any) error {
+	_, err := c.Do(ctx, "POST", c.APIURL(apiPath), args, target)
+	return err
+}
+
+// query is a POST that only reads, so it is safe to retry
+func (c *Client) query(ctx context.Context, apiPath string, args, target any) error {
+	_, err := c.do(ctx, "POST", c.APIURL(apiPath), args, target, true)
+	return err
+}
+
+func (c *Client) patch(ctx context.Context, apiPath string, args, target any) error {
+	_, err := c.Do(ctx, "PATCH", c.APIURL(apiPath), args, target)
+	return err
+}
+
+func (c *Client) del(ctx context.Context, apiPath string) error {
+	_, err := c.Do(ctx, "DELETE", c.APIURL(apiPath), nil, nil)
+	return err
+}
@@ -0,0 +1,105 @@
+package efmrlclient
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/efmrl/api2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClient(t *testing.T) {
+	var (
+		status int
+		body   string
+		got    *http.Request
+		gotArg map[string]any
+	)
+	f := func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		gotArg = nil
+		_ = json.NewDecoder(r.Body).Decode(&gotArg)
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}
+	ts := httptest.NewServer(http.HandlerFunc(f))
+	defer ts.Close()
+
+	base, err := url.Parse(ts.URL)
+	require.NoError(t, err)
+	client := New(base, ts.Client())
+
+	t.Run("success decodes data", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		status = http.StatusOK
+		body = `{"status":"success","data":{"id":"g1","name":"ops"}}`
+		group, err := client.CreateGroup(t.Context(), &api2.PostGroupReq{Name: "ops"})
+		require.NoError(err)
+		assert.Equal("g1", group.ID)
+		assert.Equal("ops", group.Name)
+		assert.Equal("POST", got.Method)
+		assert.Equal("/.e/rest/groups", got.URL.Path)
+		assert.Equal("application/json", got.Header.Get("Content-Type"))
+		assert.Equal("ops", gotArg["name"])
+	})
+
+	t.Run("JSend failure surfaces the message", func(t *testing.T) {
+		assert := assert.New(t)
+
+		status = http.StatusOK
+		body = `{"status":"fail","message":"name taken"}`
+		_, err := client.CreateGroup(t.Context(), &api2.PostGroupReq{Name: "ops"})
+		var cerr *Error
+		assert.ErrorAs(err, &cerr)
+		assert.Equal(api2.StatusFail, cerr.Status)
+		assert.Equal("name taken", cerr.Message)
+		assert.Contains(err.Error(), "name taken")
+	})
+
+	t.Run("HTTP status is an error", func(t *testing.T) {
+		assert := assert.New(t)
+
+		status = http.StatusForbidden
+		body = `{"status":"error","message":"no perms"}`
+		err := client.PatchPerms(t.Context(), &api2.AllPerms{})
+		var cerr *Error
+		assert.ErrorAs(err, &cerr)
+		assert.Equal(http.StatusForbidden, cerr.StatusCode)
+		assert.Contains(err.Error(), "no perms")
+		assert.Equal("PATCH", got.Method)
+		assert.False(IsNotFound(err))
+
+		// no body at all
+		status = http.StatusNotFound
+		body = ""
+		err = client.DeleteEmail(t.Context(), "u1", "e1")
+		assert.True(IsNotFound(err))
+		assert.Contains(err.Error(), "Not Found")
+		assert.Equal("/.e/rest/users/u1/emails/e1", got.URL.Path)
+	})
+
+	t.Run("no target needs no JSend", func(t *testing.T) {
+		assert := assert.New(t)
+
+		status = http.StatusNoContent
+		body = ""
+		assert.NoError(client.DeleteFile(t.Context(), "a/b.html"))
+		assert.Equal("DELETE", got.Method)
+		assert.Equal("/a/b.html", got.URL.Path)
+	})
+
+	t.Run("target needs a JSend body", func(t *testing.T) {
+		assert := assert.New(t)
+
+		status = http.StatusOK
+		body = "<html>"
+		_, err := client.ListUsers(t.Context())
+		assert.ErrorContains(err, "cannot decode response")
+	})
+}
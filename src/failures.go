@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"text/tabwriter"
+)
+
+// syncFailure is a file that could not be pushed or deleted
+type syncFailure struct {
+	Path  string `json:"path"`
+	Error string `json:"error"`
+}
+
+// syncFailures collects failures with --keep-going. A nil *syncFailures
+// collects nothing, so the first failure stops the sync.
+type syncFailures struct {
+	mu   sync.Mutex
+	list []*syncFailure
+}
+
+// add records a failure, and reports whether the sync should keep going
+func (sf *syncFailures) add(path string, err error) bool {
+	if sf == nil {
+		return false
+	}
+
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+	sf.list = append(sf.list, &syncFailure{Path: path, Error: err.Error()})
+
+	return true
+}
+
+// failures returns the failures so far, sorted by path
+func (sf *syncFailures) failures() []*syncFailure {
+	if sf == nil {
+		return nil
+	}
+
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+	list := append([]*syncFailure(nil), sf.list...)
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Path < list[j].Path
+	})
+
+	return list
+}
+
+// failureReport is the failures of a --keep-going sync, for --output json
+type failureReport struct {
+	Action   string         `json:"action"` // always "failures"
+	Failures []*syncFailure `json:"failures"`
+}
+
+// showFailures reports the failures of a --keep-going sync: a line of JSON
+// with --output json, and a table otherwise, even if quiet
+func (ctx *CLIContext) showFailures(failures []*syncFailure) error {
+	if ctx.isJSON() {
+		return ctx.writeJSON(&failureReport{Action: "failures", Failures: failures})
+	}
+
+	out := ctx.chatter()
+	if ctx.Output == outputPlain {
+		for _, failure := range failures {
+			fmt.Fprintf(out, "%v\t%v\n", failure.Path, failure.Error)
+		}
+		return nil
+	}
+
+	fmt.Fprintf(out, "%v failed:\n", len(failures))
+	tw := tabwriter.NewWriter(out, 0, 2, 2, ' ', 0)
+	for _, failure := range failures {
+		fmt.Fprintf(tw, "    %v\t%v\n", failure.Path, failure.Error)
+	}
+
+	return tw.Flush()
+}
@@ -4,6 +4,7 @@ go 1.24.0
 
 require (
 	github.com/alecthomas/kong v1.12.0
+	github.com/andybalholm/brotli v1.2.0
 	github.com/efmrl/api2 v0.0.0-20250824185841-d59b1e072fbd
 	github.com/fsnotify/fsnotify v1.9.0
 	github.com/stretchr/testify v1.8.4
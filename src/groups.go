@@ -1,14 +1,8 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
-	"net/http"
 	"net/http/httptest"
-	"net/url"
-	"os"
-	"path"
-	"text/tabwriter"
 
 	"github.com/efmrl/api2"
 )
@@ -37,28 +31,23 @@ func (cg *CreateGroup) Run(ctx *CLIContext) error {
 	req := &api2.PostGroupReq{
 		Name: cg.Name,
 	}
-	group := &api2.Group{}
 
-	client, err := cfg.getClient()
+	client, err := cfg.apiClient()
 	if err != nil {
 		return err
 	}
-	url := cfg.pathToAPIurl("/groups")
 
-	result := api2.NewResult(group)
-	_, err = postJSON(client, url, req, result)
+	group, err := client.CreateGroup(ctx.stopContext(), req)
 	if err != nil {
+		err = fmt.Errorf("create failed: %w", err)
 		return err
 	}
 
-	if result.Status != api2.StatusSuccess {
-		err = fmt.Errorf("create failed: %v", result.Message)
-		return err
-	}
-
-	fmt.Printf("new group ID: %q\n", group.ID)
-
-	return nil
+	return ctx.show(
+		group,
+		fmt.Sprintf("new group ID: %q", group.ID),
+		group.ID,
+	)
 }
 
 type GetGroup struct {
@@ -74,28 +63,18 @@ func (gg *GetGroup) Run(ctx *CLIContext) error {
 	}
 	cfg.ts = gg.ts
 
-	url := getGroupPath(cfg, gg.ID)
-	client, err := cfg.getClient()
+	client, err := cfg.apiClient()
 	if err != nil {
 		return err
 	}
 
-	res := &api2.Group{}
-	ngRes := api2.NewResult(res)
-	err = getJSON(client, url, ngRes)
+	res, err := client.GetGroup(ctx.stopContext(), gg.ID)
 	if err != nil {
 		err = fmt.Errorf("cannot get group data: %w", err)
 		return err
 	}
 
-	out, err := json.MarshalIndent(res, "", "    ")
-	if err != nil {
-		return err
-	}
-
-	fmt.Println(string(out))
-
-	return nil
+	return ctx.showIndented(res)
 }
 
 type ListGroups struct {
@@ -109,25 +88,21 @@ func (lg *ListGroups) Run(ctx *CLIContext) error {
 	}
 	cfg.ts = lg.ts
 
-	url := cfg.pathToAPIurl("/groups")
-	client, err := cfg.getClient()
+	client, err := cfg.apiClient()
 	if err != nil {
 		return err
 	}
-	groups := &api2.GetGroupsRes{}
-	err = getJSON(client, url, api2.NewResult(groups))
+	groups, err := client.ListGroups(ctx.stopContext())
 	if err != nil {
 		return err
 	}
 
-	tw := tabwriter.NewWriter(os.Stdout, 0, 2, 1, ' ', 0)
-
+	tbl := &table{}
 	for _, group := range groups.Groups {
-		fmt.Fprintf(tw, "%v\t %v\t\n", group.ID, group.Name)
+		tbl.add(group.ID, group.Name)
 	}
 
-	tw.Flush()
-	return nil
+	return ctx.showList(groups.Groups, tbl)
 }
 
 type UpdateGroup struct {
@@ -144,8 +119,7 @@ func (ug *UpdateGroup) Run(ctx *CLIContext) error {
 	}
 	cfg.ts = ug.ts
 
-	url := getGroupPath(cfg, ug.ID)
-	client, err := cfg.getClient()
+	client, err := cfg.apiClient()
 	if err != nil {
 		return err
 	}
@@ -153,12 +127,9 @@ func (ug *UpdateGroup) Run(ctx *CLIContext) error {
 		Name: ug.Name,
 	}
 
-	resp, err := patchJSON(ctx.Context, client, url, req, nil)
+	err = client.UpdateGroup(ctx.stopContext(), ug.ID, req)
 	if err != nil {
-		return err
-	}
-	if resp.StatusCode != http.StatusOK {
-		err = fmt.Errorf("error on update: %v", resp.Status)
+		err = fmt.Errorf("error on update: %w", err)
 		return err
 	}
 
@@ -178,36 +149,16 @@ func (dg *DeleteGroup) Run(ctx *CLIContext) error {
 	}
 	cfg.ts = dg.ts
 
-	url := getGroupPath(cfg, dg.ID)
-	client, err := cfg.getClient()
-	if err != nil {
-		return err
-	}
-
-	req, err := http.NewRequestWithContext(
-		ctx.Context,
-		"DELETE",
-		url.String(),
-		nil,
-	)
+	client, err := cfg.apiClient()
 	if err != nil {
 		return err
 	}
 
-	res, err := client.Do(req)
+	err = client.DeleteGroup(ctx.stopContext(), dg.ID)
 	if err != nil {
-		return err
-	}
-	if res.StatusCode >= 400 {
-		err = fmt.Errorf("cannot delete group: %v", res.Status)
+		err = fmt.Errorf("cannot delete group: %w", err)
 		return err
 	}
 
 	return nil
 }
-
-func getGroupPath(cfg *Config, groupID string) *url.URL {
-	path := path.Join("groups", groupID)
-	url := cfg.pathToAPIurl(path)
-	return url
-}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	// hashCacheName is the file, in the efmrl's state directory, that keeps
+	// the ETags of local files between syncs.
+	hashCacheName = "hashes.json"
+
+	currentHashCacheVersion = hashCacheVersionInitial
+	hashCacheVersionInitial = iota
+)
+
+// hashEntry is what we know about one local file. The ETags are only trusted
+// while the size, modification time and inode are unchanged.
+type hashEntry struct {
+	Size  int64  `json:"size"`
+	MTime int64  `json:"mtime"`
+	Inode uint64 `json:"inode,omitempty"`
+
+	// ETags maps part size to ETag; part size zero is the plain MD5
+	ETags map[int64]string `json:"etags"`
+	// Stored is the server's ETag for a file that pull downloaded
+	// compressed, which no local ETag can match
+	Stored string `json:"stored,omitempty"`
+}
+
+// hashCache remembers ETags of local files, keyed by path, so that a sync
+// only re-reads files that changed since the last one. A nil *hashCache
+// hashes every time.
+type hashCache struct {
+	fpath string
+
+	mu      sync.Mutex
+	dirty   bool
+	Version int                   `json:"version"`
+	Files   map[string]*hashEntry `json:"files"`
+}
+
+// loadHashCache reads the cache for cfg's efmrl. With fresh set, the saved
+// cache is ignored, but the new one will still be saved.
+func loadHashCache(cfg *Config, fresh bool) (*hashCache, error) {
+	dir, err := cfg.stateDir()
+	if err != nil {
+		return nil, err
+	}
+
+	hc := &hashCache{
+		fpath:   filepath.Join(dir, hashCacheName),
+		Version: currentHashCacheVersion,
+		Files:   map[string]*hashEntry{},
+	}
+	if fresh {
+		hc.dirty = true
+		return hc, nil
+	}
+
+	hcBytes, err := os.ReadFile(hc.fpath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return hc, nil
+		}
+		return nil, fmt.Errorf("cannot load hash cache: %w", err)
+	}
+
+	saved := &hashCache{}
+	err = json.Unmarshal(hcBytes, saved)
+	if err != nil || saved.Version != currentHashCacheVersion {
+		// the cache is only an optimization; start over
+		hc.dirty = true
+		return hc, nil
+	}
+	if saved.Files != nil {
+		hc.Files = saved.Files
+	}
+
+	return hc, nil
+}
+
+func newHashEntry(info os.FileInfo) *hashEntry {
+	return &hashEntry{
+		Size:  info.Size(),
+		MTime: info.ModTime().UnixNano(),
+		Inode: inode(info),
+		ETags: map[int64]string{},
+	}
+}
+
+func (he *hashEntry) matches(info os.FileInfo) bool {
+	return he.Size == info.Size() &&
+		he.MTime == info.ModTime().UnixNano() &&
+		he.Inode == inode(info)
+}
+
+// etag returns the ETag of the file at path for the given part size, from
+// the cache if info shows the file is unchanged.
+func (hc *hashCache) etag(
+	path string,
+	info os.FileInfo,
+	partSize int64,
+) (string, error) {
+	if hc == nil {
+		return etag(path, partSize)
+	}
+
+	hc.mu.Lock()
+	he := hc.Files[path]
+	if he != nil && he.matches(info) {
+		if et, ok := he.ETags[partSize]; ok {
+			hc.mu.Unlock()
+			return et, nil
+		}
+	}
+	hc.mu.Unlock()
+
+	et, err := etag(path, partSize)
+	if err != nil {
+		return "", err
+	}
+
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	he = hc.Files[path]
+	if he == nil || !he.matches(info) {
+		he = newHashEntry(info)
+		hc.Files[path] = he
+	}
+	he.ETags[partSize] = et
+	hc.dirty = true
+
+	return et, nil
+}
+
+// setStored notes that the server keeps the file at path compressed, with
+// the ETag remote
+func (hc *hashCache) setStored(path string, info os.FileInfo, remote string) {
+	if hc == nil {
+		return
+	}
+
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	he := hc.Files[path]
+	if he == nil || !he.matches(info) {
+		he = newHashEntry(info)
+		hc.Files[path] = he
+	}
+	he.Stored = remote
+	hc.dirty = true
+}
+
+// stored returns the server's ETag for the file at path if it was pulled
+// compressed, and hasn't changed since
+func (hc *hashCache) stored(path string, info os.FileInfo) string {
+	if hc == nil {
+		return ""
+	}
+
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	he := hc.Files[path]
+	if he == nil || !he.matches(info) {
+		return ""
+	}
+
+	return he.Stored
+}
+
+// matchETag is matchETagFunc, using the cache for local ETags
+func (hc *hashCache) matchETag(
+	path string,
+	remote string,
+	info os.FileInfo,
+) (string, bool, error) {
+	hash := func(path string, partSize int64) (string, error) {
+		return hc.etag(path, info, partSize)
+	}
+
+	return matchETagFunc(hash, path, remote, info.Size())
+}
+
+// save writes the cache if it changed, dropping entries for files that no
+// longer exist.
+func (hc *hashCache) save() error {
+	if hc == nil {
+		return nil
+	}
+
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+
+	for path := range hc.Files {
+		if _, err := os.Lstat(path); os.IsNotExist(err) {
+			delete(hc.Files, path)
+			hc.dirty = true
+		}
+	}
+	if !hc.dirty {
+		return nil
+	}
+
+	hcBytes, err := json.Marshal(hc)
+	if err != nil {
+		return err
+	}
+	err = writeFileAtomic(hc.fpath, hcBytes, 0600)
+	if err != nil {
+		return fmt.Errorf("cannot save hash cache: %w", err)
+	}
+	hc.dirty = false
+
+	return nil
+}
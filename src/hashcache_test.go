@@ -0,0 +1,74 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHashCache(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	cleanup, err := fakeHome(t)
+	require.NoError(err)
+	defer cleanup()
+
+	cfg := &Config{
+		Efmrl:    "cache-money",
+		CanonURL: "https://cache-money.example.com/",
+	}
+	require.NoError(cfg.prep())
+
+	fpath := filepath.Join(t.TempDir(), "page.html")
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	writeFile := func(contents string) os.FileInfo {
+		require.NoError(os.WriteFile(fpath, []byte(contents), 0666))
+		require.NoError(os.Chtimes(fpath, mtime, mtime))
+		info, err := os.Stat(fpath)
+		require.NoError(err)
+		return info
+	}
+
+	info := writeFile("hello")
+	hc, err := loadHashCache(cfg, false)
+	require.NoError(err)
+	first, err := hc.etag(fpath, info, 0)
+	require.NoError(err)
+	require.NoError(hc.save())
+
+	// same size and mtime: the cache is trusted, even though it's now wrong
+	info = writeFile("jello")
+	hc, err = loadHashCache(cfg, false)
+	require.NoError(err)
+	cached, err := hc.etag(fpath, info, 0)
+	assert.NoError(err)
+	assert.Equal(first, cached)
+
+	// rehash ignores the cache
+	hc, err = loadHashCache(cfg, true)
+	require.NoError(err)
+	fresh, err := hc.etag(fpath, info, 0)
+	assert.NoError(err)
+	assert.NotEqual(first, fresh)
+
+	// a changed mtime invalidates the entry
+	mtime = mtime.Add(time.Second)
+	info = writeFile("jello")
+	hc, err = loadHashCache(cfg, false)
+	require.NoError(err)
+	changed, err := hc.etag(fpath, info, 0)
+	assert.NoError(err)
+	assert.Equal(fresh, changed)
+
+	// entries for deleted files are dropped on save
+	require.NoError(os.Remove(fpath))
+	require.NoError(hc.save())
+	hc, err = loadHashCache(cfg, false)
+	require.NoError(err)
+	assert.Empty(hc.Files)
+}
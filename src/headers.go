@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// headerRule sets headers on the files that match a glob. Globs use the
+// same syntax as .efmrlignore, relative to the efmrl. Rules are applied in
+// order, so later rules override earlier ones.
+type headerRule struct {
+	Match   string            `json:"match"`
+	Headers map[string]string `json:"headers"`
+
+	pattern *ignorePattern // compiled from Match
+}
+
+// compileHeaderRules compiles every rule's glob, so bad ones are reported
+// when the config is loaded.
+func (cfg *Config) compileHeaderRules() error {
+	for _, rule := range cfg.Headers {
+		pat, err := compileIgnorePattern(rule.Match)
+		if err != nil {
+			return fmt.Errorf("bad header rule %q: %w", rule.Match, err)
+		}
+		if pat == nil || pat.negate {
+			return fmt.Errorf("bad header rule %q: empty or negated", rule.Match)
+		}
+		rule.pattern = pat
+	}
+
+	return nil
+}
+
+// matches reports whether rel, a slash-separated path relative to the efmrl,
+// or any directory above it matches the rule.
+func (rule *headerRule) matches(rel string) (bool, error) {
+	pat := rule.pattern
+	if pat == nil {
+		var err error
+		pat, err = compileIgnorePattern(rule.Match)
+		if err != nil || pat == nil {
+			return false, fmt.Errorf("bad header rule %q", rule.Match)
+		}
+	}
+
+	return pat.matchesPath(rel), nil
+}
+
+// headersFor returns the headers that the file at rel, relative to the top
+// of the efmrl, is pushed with: Cache-Control is defaultCache unless a rule says
+// otherwise.
+func (cfg *Config) headersFor(rel string) (http.Header, error) {
+	headers := http.Header{}
+	headers.Set(cacheControlHeader, defaultCache)
+
+	rel = strings.Trim(filepath.ToSlash(rel), "/")
+	for _, rule := range cfg.Headers {
+		match, err := rule.matches(rel)
+		if err != nil {
+			return nil, err
+		}
+		if !match {
+			continue
+		}
+		for name, value := range rule.Headers {
+			headers.Set(name, value)
+		}
+	}
+
+	return headers, nil
+}
+
+// headersDiffer asks the server for the headers of url and reports whether
+// any of want are different. Content-Type is left out, since the server may
+// add parameters to it.
+func headersDiffer(
+	ctx context.Context,
+	client *http.Client,
+	url string,
+	want http.Header,
+) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, "HEAD", url, nil)
+	if err != nil {
+		return false, err
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("status %v getting headers of %v", res.Status, url)
+	}
+
+	for name := range want {
+		if http.CanonicalHeaderKey(name) == contentTypeHeader {
+			continue
+		}
+		if res.Header.Get(name) != want.Get(name) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+const (
+	// summaryEnv holds the sync summary, as JSON, for the post_sync hook
+	summaryEnv = "EFMRL_SYNC_SUMMARY"
+	// dryRunEnv is set to "1" for hooks run by a dry run
+	dryRunEnv = "EFMRL_DRY_RUN"
+)
+
+// hooksConfig holds commands that sync runs, with the shell, in the
+// directory of the config file. If one fails, the sync stops, and its
+// output is shown.
+type hooksConfig struct {
+	// Build makes the files under RootDir. It runs before they are walked;
+	// with --watch, it runs again when any of Sources change.
+	Build string `json:"build,omitempty"`
+	// Sources are the files and directories, relative to the config file,
+	// that Build reads
+	Sources []string `json:"sources,omitempty"`
+	// PreSync runs after Build, before anything is pushed
+	PreSync string `json:"pre_sync,omitempty"`
+	// PostSync runs after a sync that succeeds, with its summary in
+	// $EFMRL_SYNC_SUMMARY. It doesn't run on a dry run.
+	PostSync string `json:"post_sync,omitempty"`
+}
+
+// runHook runs the named hook, if it is set. Its output is shown unless
+// quiet, and put in the error if it fails.
+func (s *SyncCmd) runHook(
+	ctx *CLIContext,
+	cfg *Config,
+	name string,
+	env ...string,
+) error {
+	if cfg.Hooks == nil || s.NoHooks {
+		return nil
+	}
+	command := map[string]string{
+		"build":     cfg.Hooks.Build,
+		"pre_sync":  cfg.Hooks.PreSync,
+		"post_sync": cfg.Hooks.PostSync,
+	}[name]
+	if command == "" {
+		return nil
+	}
+
+	ctx.logger().Debug("running hook", "hook", name, "command", command)
+	out := &bytes.Buffer{}
+	cmd := hookCommand(ctx.stopContext(), command)
+	cmd.Stdout = out
+	cmd.Stderr = out
+	cmd.Env = append(os.Environ(), env...)
+	if s.DryRun {
+		cmd.Env = append(cmd.Env, dryRunEnv+"=1")
+	}
+	err := cmd.Run()
+	if err != nil {
+		output := strings.TrimRight(out.String(), "\n")
+		if output == "" {
+			return fmt.Errorf("%v hook %q failed: %w", name, command, err)
+		}
+		return fmt.Errorf("%v hook %q failed: %w\n%v", name, command, err, output)
+	}
+	if !ctx.Quiet && out.Len() > 0 {
+		ctx.outMu.Lock()
+		defer ctx.outMu.Unlock()
+		_, err = ctx.chatter().Write(out.Bytes())
+	}
+
+	return err
+}
+
+// runPostSync runs the post_sync hook with the summary of a sync
+func (s *SyncCmd) runPostSync(ctx *CLIContext, cfg *Config, summary *syncSummary) error {
+	if s.DryRun {
+		return nil
+	}
+	summaryJSON, err := json.Marshal(summary)
+	if err != nil {
+		return err
+	}
+
+	return s.runHook(ctx, cfg, "post_sync", summaryEnv+"="+string(summaryJSON))
+}
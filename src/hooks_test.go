@@ -0,0 +1,100 @@
+//go:build !windows
+
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHooks(t *testing.T) {
+	goBack, err := cdTmp(t)
+	require.NoError(t, err)
+	defer goBack()
+	cleanup, err := fakeHome(t)
+	require.NoError(t, err)
+	defer cleanup()
+
+	newConfig := func(ts *httptest.Server, hooks *hooksConfig) *Config {
+		cfg := &Config{
+			Efmrl:    "hooked",
+			CanonURL: ts.URL,
+			RootDir:  "built",
+			Hooks:    hooks,
+			ts:       ts,
+		}
+		require.NoError(t, cfg.prep())
+		return cfg
+	}
+
+	t.Run("build, pre and post", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		fe, ts := newFakeEfmrl(nil)
+		defer ts.Close()
+		cfg := newConfig(ts, &hooksConfig{
+			Build:    "mkdir -p built && echo hi > built/gen.txt",
+			PreSync:  "test -f built/gen.txt && echo pre > pre.out",
+			PostSync: `printf '%s' "$EFMRL_SYNC_SUMMARY" > post.json`,
+		})
+
+		sync := &SyncCmd{Parallel: 2, ts: ts}
+		require.NoError(sync.sync(&CLIContext{Quiet: true}, cfg))
+		assert.Equal("hi\n", fe.files["/gen.txt"])
+		assert.FileExists("pre.out")
+
+		data, err := os.ReadFile("post.json")
+		require.NoError(err)
+		summary := &syncSummary{}
+		require.NoError(json.Unmarshal(data, summary))
+		assert.Equal("summary", summary.Action)
+		assert.Equal(int64(1), summary.Uploaded)
+
+		// no post hook on a dry run
+		require.NoError(os.Remove("post.json"))
+		sync = &SyncCmd{DryRun: true, Parallel: 2, ts: ts}
+		require.NoError(sync.sync(&CLIContext{Quiet: true}, cfg))
+		assert.NoFileExists("post.json")
+	})
+
+	t.Run("a failing hook stops the sync", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		fe, ts := newFakeEfmrl(nil)
+		defer ts.Close()
+		cfg := newConfig(ts, &hooksConfig{
+			PreSync:  "echo cannot reach the CDN; exit 3",
+			PostSync: "touch post.out",
+		})
+
+		sync := &SyncCmd{Parallel: 2, ts: ts}
+		err := sync.sync(&CLIContext{Quiet: true}, cfg)
+		require.Error(err)
+		assert.Contains(err.Error(), "pre_sync hook")
+		assert.Contains(err.Error(), "exit status 3")
+		assert.Contains(err.Error(), "cannot reach the CDN")
+		assert.Empty(fe.log)
+		assert.NoFileExists("post.out")
+
+		sync = &SyncCmd{NoHooks: true, Parallel: 2, ts: ts}
+		require.NoError(sync.sync(&CLIContext{Quiet: true}, cfg))
+		assert.Contains(fe.log, "PUT /gen.txt")
+	})
+
+	t.Run("sources", func(t *testing.T) {
+		assert := assert.New(t)
+
+		assert.True(isUnder("src", "src"))
+		assert.True(isUnder("src/a/b.js", "lib", "src"))
+		assert.True(isUnder("package.json", "package.json"))
+		assert.False(isUnder("srcs/a.js", "src"))
+		assert.False(isUnder("built/a.js", "src", "package.json"))
+	})
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// ignoreFileName is the name of the per-directory file listing paths that
+// should not be synced. It uses the same syntax as .gitignore.
+const ignoreFileName = ".efmrlignore"
+
+// ignorePattern is one compiled line of an ignore file
+type ignorePattern struct {
+	re      *regexp.Regexp
+	negate  bool
+	dirOnly bool
+}
+
+// matchesPath reports whether rel, a slash-separated path relative to the
+// root, or any directory above it matches the pattern. Negation is left to
+// the caller.
+func (pat *ignorePattern) matchesPath(rel string) bool {
+	if !pat.dirOnly && pat.re.MatchString(rel) {
+		return true
+	}
+	for dir := path.Dir(rel); dir != "." && dir != "/"; dir = path.Dir(dir) {
+		if pat.re.MatchString(dir) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ignorer decides which paths under the root directory are left out of
+// syncing. Patterns come from the "ignore" list in the config, which is
+// relative to the root directory, and from any .efmrlignore files found in
+// the root directory or below it. As with git, later patterns override
+// earlier ones, and patterns in deeper directories override shallower ones.
+type ignorer struct {
+	root string
+
+	mu       sync.Mutex
+	patterns map[string][]*ignorePattern // by slash-separated dir under root
+	dirs     map[string]bool             // cached answers for directories
+}
+
+func newIgnorer(root string, patterns []string) (*ignorer, error) {
+	ig := &ignorer{
+		root:     root,
+		patterns: map[string][]*ignorePattern{},
+		dirs:     map[string]bool{},
+	}
+
+	var rootPatterns []*ignorePattern
+	for _, line := range patterns {
+		pat, err := compileIgnorePattern(line)
+		if err != nil {
+			return nil, fmt.Errorf("bad ignore pattern %q: %w", line, err)
+		}
+		if pat != nil {
+			rootPatterns = append(rootPatterns, pat)
+		}
+	}
+
+	filePatterns, err := ig.readIgnoreFile("")
+	if err != nil {
+		return nil, err
+	}
+	ig.patterns[""] = append(rootPatterns, filePatterns...)
+
+	return ig, nil
+}
+
+// ignored reports whether rel, a slash-separated path relative to the root
+// directory, should be skipped. A path is ignored if it matches, or if any
+// directory above it is ignored.
+func (ig *ignorer) ignored(rel string, isDir bool) (bool, error) {
+	rel = strings.Trim(rel, "/")
+	if rel == "" || rel == "." {
+		return false, nil
+	}
+	if !isDir && path.Base(rel) == ignoreFileName {
+		return true, nil
+	}
+
+	ig.mu.Lock()
+	defer ig.mu.Unlock()
+
+	for i := 0; i < len(rel); i++ {
+		if rel[i] != '/' {
+			continue
+		}
+		skip, err := ig.dirIgnored(rel[:i])
+		if err != nil {
+			return false, err
+		}
+		if skip {
+			return true, nil
+		}
+	}
+
+	if isDir {
+		return ig.dirIgnored(rel)
+	}
+
+	return ig.match(rel, false)
+}
+
+// dirIgnored answers, and caches, whether the directory itself matches.
+// ig.mu must be held.
+func (ig *ignorer) dirIgnored(dir string) (bool, error) {
+	if skip, ok := ig.dirs[dir]; ok {
+		return skip, nil
+	}
+
+	skip, err := ig.match(dir, true)
+	if err != nil {
+		return false, err
+	}
+	ig.dirs[dir] = skip
+
+	return skip, nil
+}
+
+// match runs rel through the patterns of every directory above it, without
+// looking at whether those directories are themselves ignored. ig.mu must be
+// held.
+func (ig *ignorer) match(rel string, isDir bool) (bool, error) {
+	var skip bool
+
+	base := ""
+	for {
+		patterns, err := ig.load(base)
+		if err != nil {
+			return false, err
+		}
+
+		sub := rel
+		if base != "" {
+			sub = rel[len(base)+1:]
+		}
+		for _, pat := range patterns {
+			if pat.dirOnly && !isDir {
+				continue
+			}
+			if pat.re.MatchString(sub) {
+				skip = !pat.negate
+			}
+		}
+
+		next := strings.IndexByte(sub, '/')
+		if next < 0 {
+			break
+		}
+		base = rel[:len(rel)-len(sub)+next]
+	}
+
+	return skip, nil
+}
+
+// load returns the patterns for dir, reading its ignore file the first time.
+// ig.mu must be held.
+func (ig *ignorer) load(dir string) ([]*ignorePattern, error) {
+	if patterns, ok := ig.patterns[dir]; ok {
+		return patterns, nil
+	}
+
+	patterns, err := ig.readIgnoreFile(dir)
+	if err != nil {
+		return nil, err
+	}
+	ig.patterns[dir] = patterns
+
+	return patterns, nil
+}
+
+func (ig *ignorer) readIgnoreFile(dir string) ([]*ignorePattern, error) {
+	fpath := filepath.Join(ig.root, filepath.FromSlash(dir), ignoreFileName)
+	f, err := os.Open(fpath)
+	if err != nil {
+		if os.IsNotExist(err) || os.IsPermission(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("cannot read %q: %w", fpath, err)
+	}
+	defer f.Close()
+
+	var patterns []*ignorePattern
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		pat, err := compileIgnorePattern(scanner.Text())
+		if err != nil {
+			return nil, fmt.Errorf("%v:%v: %w", fpath, lineNo, err)
+		}
+		if pat != nil {
+			patterns = append(patterns, pat)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("cannot read %q: %w", fpath, err)
+	}
+
+	return patterns, nil
+}
+
+// compileIgnorePattern turns one line of gitignore syntax into a pattern. It
+// returns nil for blank lines and comments.
+func compileIgnorePattern(line string) (*ignorePattern, error) {
+	line = strings.TrimSuffix(line, "\r")
+	for strings.HasSuffix(line, " ") && !strings.HasSuffix(line, `\ `) {
+		line = line[:len(line)-1]
+	}
+	if line == "" || line[0] == '#' {
+		return nil, nil
+	}
+
+	pat := &ignorePattern{}
+	switch {
+	case line[0] == '!':
+		pat.negate = true
+		line = line[1:]
+	case strings.HasPrefix(line, `\!`), strings.HasPrefix(line, `\#`):
+		line = line[1:]
+	}
+
+	if strings.HasSuffix(line, "/") {
+		pat.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if line == "" {
+		return nil, nil
+	}
+
+	// a slash anywhere but the end anchors the pattern to its directory
+	anchored := strings.Contains(line, "/")
+	line = strings.TrimPrefix(line, "/")
+
+	expr := &strings.Builder{}
+	expr.WriteString("^")
+	if !anchored {
+		expr.WriteString("(?:.*/)?")
+	}
+
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case strings.HasPrefix(line[i:], "**/") && (i == 0 || line[i-1] == '/'):
+			expr.WriteString("(?:.*/)?")
+			i += 2
+		case line[i:] == "**" && (i == 0 || line[i-1] == '/'):
+			expr.WriteString(".*")
+			i++
+		case c == '*':
+			expr.WriteString("[^/]*")
+		case c == '?':
+			expr.WriteString("[^/]")
+		case c == '[':
+			end := strings.IndexByte(line[i+1:], ']')
+			if end < 0 {
+				expr.WriteString(regexp.QuoteMeta("["))
+				continue
+			}
+			class := line[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			expr.WriteString("[" + strings.ReplaceAll(class, `\`, `\\`) + "]")
+			i += end + 1
+		case c == '\\' && i+1 < len(line):
+			i++
+			expr.WriteString(regexp.QuoteMeta(line[i : i+1]))
+		default:
+			expr.WriteString(regexp.QuoteMeta(line[i : i+1]))
+		}
+	}
+	expr.WriteString("$")
+
+	re, err := regexp.Compile(expr.String())
+	if err != nil {
+		return nil, err
+	}
+	pat.re = re
+
+	return pat, nil
+}
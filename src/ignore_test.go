@@ -0,0 +1,107 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIgnore(t *testing.T) {
+	t.Run("patterns follow gitignore rules", func(t *testing.T) {
+		type ignoreCases []struct {
+			pattern string
+			path    string
+			isDir   bool
+			match   bool
+		}
+
+		assert := assert.New(t)
+		require := require.New(t)
+
+		var cases = ignoreCases{
+			{pattern: "*.map", path: "app.js.map", match: true},
+			{pattern: "*.map", path: "js/deep/app.js.map", match: true},
+			{pattern: "*.map", path: "app.js", match: false},
+			{pattern: ".DS_Store", path: "a/b/.DS_Store", match: true},
+			{pattern: "/top.txt", path: "top.txt", match: true},
+			{pattern: "/top.txt", path: "sub/top.txt", match: false},
+			{pattern: "docs/*.md", path: "docs/a.md", match: true},
+			{pattern: "docs/*.md", path: "x/docs/a.md", match: false},
+			{pattern: "docs/*.md", path: "docs/a/b.md", match: false},
+			{pattern: "build/", path: "build", isDir: true, match: true},
+			{pattern: "build/", path: "build", isDir: false, match: false},
+			{pattern: "**/cache", path: "a/b/cache", match: true},
+			{pattern: "a/**/z", path: "a/z", match: true},
+			{pattern: "a/**/z", path: "a/b/c/z", match: true},
+			{pattern: "a/**", path: "a/b/c", match: true},
+			{pattern: "file?.txt", path: "file1.txt", match: true},
+			{pattern: "file?.txt", path: "file10.txt", match: false},
+			{pattern: "[!a]*.txt", path: "b.txt", match: true},
+			{pattern: "[!a]*.txt", path: "a.txt", match: false},
+			{pattern: `\#hash`, path: "#hash", match: true},
+		}
+		for _, c := range cases {
+			pat, err := compileIgnorePattern(c.pattern)
+			require.NoError(err)
+			require.NotNil(pat)
+			match := pat.re.MatchString(c.path) && (c.isDir || !pat.dirOnly)
+			assert.Equalf(c.match, match, "case %#v", c)
+		}
+
+		for _, blank := range []string{"", "   ", "# comment"} {
+			pat, err := compileIgnorePattern(blank)
+			assert.NoError(err)
+			assert.Nil(pat)
+		}
+	})
+
+	t.Run("nested ignore files and negation", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		root := t.TempDir()
+		files := map[string]string{
+			ignoreFileName:                       "*.log\nnode_modules/\n",
+			filepath.Join("sub", ignoreFileName): "!keep.log\n/local.txt\n",
+		}
+		for fname, contents := range files {
+			fpath := filepath.Join(root, fname)
+			err := os.MkdirAll(filepath.Dir(fpath), 0777)
+			require.NoError(err)
+			err = os.WriteFile(fpath, []byte(contents), 0666)
+			require.NoError(err)
+		}
+
+		ig, err := newIgnorer(root, []string{"*.swp"})
+		require.NoError(err)
+
+		type ignoreCases []struct {
+			path  string
+			isDir bool
+			skip  bool
+		}
+		var cases = ignoreCases{
+			{path: "index.html", skip: false},
+			{path: ".index.html.swp", skip: true},
+			{path: "error.log", skip: true},
+			{path: "sub/error.log", skip: true},
+			{path: "sub/keep.log", skip: false},
+			{path: "keep.log", skip: true},
+			{path: "sub/local.txt", skip: true},
+			{path: "local.txt", skip: false},
+			{path: "node_modules", isDir: true, skip: true},
+			{path: "node_modules/x/index.js", skip: true},
+			{path: "sub/node_modules/y.js", skip: true},
+			{path: ignoreFileName, skip: true},
+			{path: "sub/" + ignoreFileName, skip: true},
+		}
+		for _, c := range cases {
+			skip, err := ig.ignored(c.path, c.isDir)
+			assert.NoError(err)
+			assert.Equalf(c.skip, skip, "case %#v", c)
+		}
+	})
+}
@@ -0,0 +1,10 @@
+//go:build windows
+
+package main
+
+import "os"
+
+// inode returns zero; FileInfo from os.Stat carries no file index on Windows
+func inode(info os.FileInfo) uint64 {
+	return 0
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// redacted replaces secrets, such as cookies, in logged headers
+const redacted = "REDACTED"
+
+// secretHeaders are never logged as is
+var secretHeaders = []string{"Authorization", "Cookie", "Set-Cookie"}
+
+// newLogger returns a logger for the global flags: errors only if quiet,
+// warnings by default, and more with verbose or debug. Output is JSON with
+// --output json, and text otherwise.
+func newLogger(w io.Writer, quiet, verbose, debug, asJSON bool) *slog.Logger {
+	level := slog.LevelWarn
+	switch {
+	case debug:
+		level = slog.LevelDebug
+	case verbose:
+		level = slog.LevelInfo
+	case quiet:
+		level = slog.LevelError
+	}
+
+	opts := &slog.HandlerOptions{Level: level}
+	if asJSON {
+		return slog.New(slog.NewJSONHandler(w, opts))
+	}
+	return slog.New(slog.NewTextHandler(w, opts))
+}
+
+// logger returns the logger for the command; the default one if the
+// context has none
+func (ctx *CLIContext) logger() *slog.Logger {
+	if ctx == nil || ctx.Log == nil {
+		return slog.Default()
+	}
+	return ctx.Log
+}
+
+// loggingTransport logs every request at debug level, to slog's default
+// logger, which main sets to the CLIContext's.
+type loggingTransport struct {
+	next http.RoundTripper
+}
+
+func (lt *loggingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	log := slog.Default()
+	if !log.Enabled(req.Context(), slog.LevelDebug) {
+		return lt.next.RoundTrip(req)
+	}
+
+	start := time.Now()
+	res, err := lt.next.RoundTrip(req)
+	attrs := []any{
+		"method", req.Method,
+		"url", req.URL.String(),
+		"latency", time.Since(start),
+		"request_headers", redactHeaders(req.Header),
+	}
+	if err != nil {
+		log.Debug("http", append(attrs, "error", err)...)
+		return res, err
+	}
+	log.Debug("http", append(attrs,
+		"status", res.StatusCode,
+		"response_headers", redactHeaders(res.Header),
+	)...)
+
+	return res, nil
+}
+
+// redactHeaders returns a copy of headers with secrets replaced
+func redactHeaders(headers http.Header) http.Header {
+	headers = headers.Clone()
+	for _, name := range secretHeaders {
+		if headers.Get(name) != "" {
+			headers.Set(name, redacted)
+		}
+	}
+	return headers
+}
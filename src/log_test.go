@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoggingTransport(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	f := func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "from-server"})
+		w.WriteHeader(http.StatusTeapot)
+	}
+	ts := httptest.NewServer(http.HandlerFunc(f))
+	defer ts.Close()
+
+	buf := &bytes.Buffer{}
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(newLogger(buf, false, false, true, true))
+
+	client := &http.Client{Transport: &loggingTransport{next: http.DefaultTransport}}
+	req, err := http.NewRequest("GET", ts.URL+"/api/x", nil)
+	require.NoError(err)
+	req.AddCookie(&http.Cookie{Name: "session", Value: "from-client"})
+	res, err := client.Do(req)
+	require.NoError(err)
+	res.Body.Close()
+
+	logged := buf.String()
+	assert.Contains(logged, `"method":"GET"`)
+	assert.Contains(logged, `"url":"`+ts.URL+`/api/x"`)
+	assert.Contains(logged, `"status":418`)
+	assert.Contains(logged, `"latency"`)
+	assert.Contains(logged, redacted)
+	assert.NotContains(logged, "from-client")
+	assert.NotContains(logged, "from-server")
+
+	// nothing is logged above debug level
+	buf.Reset()
+	slog.SetDefault(newLogger(buf, false, true, false, true))
+	res, err = client.Do(req)
+	require.NoError(err)
+	res.Body.Close()
+	assert.Empty(buf.String())
+}
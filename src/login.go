@@ -1,10 +1,7 @@
 package main
 
 import (
-	"bytes"
-	"encoding/json"
 	"fmt"
-	"net/http"
 	"net/http/httptest"
 
 	"github.com/efmrl/api2"
@@ -27,26 +24,17 @@ func (ns *NewSessionGet) Run(ctx *CLIContext) error {
 	}
 	cfg.ts = ns.ts
 
-	url := cfg.pathToAPIurl("session")
-	client, err := cfg.getClient()
+	client, err := cfg.apiClient()
 	if err != nil {
 		return err
 	}
 
-	res := &api2.SessionRes{}
-	err = getJSON(client, url, api2.NewResult(res))
+	res, err := client.Session(ctx.stopContext())
 	if err != nil {
 		return err
 	}
 
-	out, err := json.MarshalIndent(res, "", "    ")
-	if err != nil {
-		return err
-	}
-
-	fmt.Println(string(out))
-
-	return nil
+	return ctx.showIndented(res)
 }
 
 type DeclareCmd struct {
@@ -67,9 +55,7 @@ func (dc *DeclareCmd) Run(ctx *CLIContext) error {
 		return err
 	}
 
-	url := cfg.pathToAPIurl("session")
-
-	client, err := cfg.getClient()
+	client, err := cfg.apiClient()
 	if err != nil {
 		return err
 	}
@@ -78,60 +64,19 @@ func (dc *DeclareCmd) Run(ctx *CLIContext) error {
 		CookieOK: true,
 		UserKey:  dc.Who,
 	}
-	res := api2.NewResult(&api2.SessionRes{})
-
-	message, err := json.Marshal(req)
-	if err != nil {
-		return err
-	}
-	pres, err := client.Post(
-		url.String(),
-		"application/json",
-		bytes.NewReader(message),
-	)
-	if err != nil {
-		err = fmt.Errorf("cannot connect to server: %w", err)
-		return err
-	}
-
-	defer pres.Body.Close()
-	dec := json.NewDecoder(pres.Body)
-
-	if pres.StatusCode != http.StatusOK {
-		stuff := map[string]any{}
-		if dec.Decode(&stuff) == nil {
-			out, err := json.MarshalIndent(stuff, "", "    ")
-			if err == nil {
-				fmt.Println(string(out))
-			}
-		}
-
-		return fmt.Errorf("declare failed: %v", pres.Status)
-	}
-
-	err = dec.Decode(res)
-	if err != nil {
-		return err
-	}
-	if res.Status != api2.StatusSuccess {
-		err = fmt.Errorf("%v: %v", res.Status, res.Message)
-		return err
-	}
-
-	out, err := json.MarshalIndent(res.Data, "", "    ")
+	res, err := client.PostSession(ctx.stopContext(), req)
 	if err != nil {
+		err = fmt.Errorf("declare failed: %w", err)
 		return err
 	}
 
-	gecfg.Secrets.eatAllCookies(client, url)
+	gecfg.Secrets.eatAllCookies(client.HTTP, client.APIURL("session"))
 	err = cfg.save()
 	if err != nil {
 		return err
 	}
 
-	fmt.Println(string(out))
-
-	return nil
+	return ctx.showIndented(res)
 }
 
 type ConfirmCmd struct {
@@ -152,8 +97,7 @@ func (cc *ConfirmCmd) Run(ctx *CLIContext) error {
 		return err
 	}
 
-	url := cfg.pathToAPIurl("session")
-	client, err := cfg.getClient()
+	client, err := cfg.apiClient()
 	if err != nil {
 		return err
 	}
@@ -162,58 +106,17 @@ func (cc *ConfirmCmd) Run(ctx *CLIContext) error {
 		CookieOK:   true,
 		UserSecret: cc.Secret,
 	}
-	res := api2.NewResult(&api2.SessionRes{})
-
-	message, err := json.Marshal(req)
-	if err != nil {
-		return err
-	}
-	pres, err := client.Post(
-		url.String(),
-		"application/json",
-		bytes.NewReader(message),
-	)
-	if err != nil {
-		err = fmt.Errorf("cannot connect to server: %w", err)
-		return err
-	}
-
-	defer pres.Body.Close()
-	dec := json.NewDecoder(pres.Body)
-
-	if pres.StatusCode != http.StatusOK {
-		stuff := map[string]any{}
-		if dec.Decode(&stuff) == nil {
-			out, err := json.MarshalIndent(stuff, "", "    ")
-			if err == nil {
-				fmt.Println(string(out))
-			}
-		}
-
-		return fmt.Errorf("confirm failed: %v", pres.Status)
-	}
-
-	err = dec.Decode(res)
+	res, err := client.PostSession(ctx.stopContext(), req)
 	if err != nil {
-		return err
-	}
-	if res.Status != api2.StatusSuccess {
-		err = fmt.Errorf("%v: %v", res.Status, res.Message)
+		err = fmt.Errorf("confirm failed: %w", err)
 		return err
 	}
 
-	out, err := json.MarshalIndent(res.Data, "", "    ")
-	if err != nil {
-		return err
-	}
-
-	gecfg.Secrets.eatAllCookies(client, url)
+	gecfg.Secrets.eatAllCookies(client.HTTP, client.APIURL("session"))
 	err = cfg.save()
 	if err != nil {
 		return err
 	}
 
-	fmt.Println(string(out))
-
-	return nil
+	return ctx.showIndented(res)
 }
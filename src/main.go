@@ -2,7 +2,14 @@ package main
 
 import (
 	"context"
-	"fmt"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/alecthomas/kong"
 )
@@ -13,34 +20,92 @@ var (
 	date    = "unknown"
 )
 
+// exit codes other than kong's 0 for success and 1 for errors
+const (
+	// exitDiffers means "status" found local and remote files that differ
+	exitDiffers = 3
+	// exitFailures means "sync --keep-going" finished, but some files
+	// failed
+	exitFailures = 4
+	// exitInterrupted means the user stopped efmrl with SIGINT or SIGTERM,
+	// as shells report for SIGINT
+	exitInterrupted = 130
+)
+
+// exitError is an error that makes efmrl exit with a particular code
+type exitError struct {
+	code int
+	err  error
+}
+
+func (ee *exitError) Error() string {
+	return ee.err.Error()
+}
+
+func (ee *exitError) Unwrap() error {
+	return ee.err
+}
+
+// ExitCode is used by kong to pick the exit status
+func (ee *exitError) ExitCode() int {
+	return ee.code
+}
+
 // CLIContext is for the CLI stuff
 type CLIContext struct {
-	Context context.Context
+	Context context.Context // done on SIGINT or SIGTERM
 	Debug   bool
 	Quiet   bool
+	Verbose bool
+	Log     *slog.Logger
+	Output  string    // one of outputTable, outputPlain or outputJSON
+	Stdout  io.Writer // where results go, if not os.Stdout
+
+	live liveDisplay // drawn below event lines, like sync's progress
+
+	outMu sync.Mutex // keeps lines of JSON whole
+}
+
+// stopContext returns the context that is done when the user asks efmrl to
+// stop
+func (ctx *CLIContext) stopContext() context.Context {
+	if ctx == nil || ctx.Context == nil {
+		return context.Background()
+	}
+	return ctx.Context
 }
 
 // cli defines the overall CLI
 var cli struct {
-	Version kong.VersionFlag `help:"print current version and exit"`
-	Hello   HelloCmd         `cmd:"" help:"say hello world" hidden:""`
-	Init    InitCmd          `cmd:"" help:"init a new working area"`
-	Set     SetCmd           `cmd:"" help:"update settings"`
-	Sync    SyncCmd          `cmd:"" help:"sync working directory to cloud"`
-	Names   NamesCmd         `cmd:"" help:"efmrl names"`
-	User    UserCmd          `cmd:"" help:"user commands"`
-	Group   GroupCmd         `cmd:"" help:"group commands"`
-	Login   Session          `cmd:"" help:"login commands"`
-	Perms   PermsCmd         `cmd:"" help:"permissions commands"`
+	Version      kong.VersionFlag `help:"print current version and exit"`
+	Output       string           `short:"o" enum:"table,plain,json" default:"table" help:"output format: table, plain or json"`
+	Quiet        bool             `short:"q" help:"only show results and errors"`
+	Verbose      bool             `short:"v" help:"show more detail"`
+	Debug        bool             `help:"show debugging output, including every HTTP request"`
+	Retries      int              `help:"retry failed requests up to this many times (default from config, or 5; negative disables)"`
+	RetryMaxWait time.Duration    `help:"longest to wait between retries (default from config, or 30s)"`
+	Hello        HelloCmd         `cmd:"" help:"say hello world" hidden:""`
+	Init         InitCmd          `cmd:"" help:"init a new working area"`
+	Set          SetCmd           `cmd:"" help:"update settings"`
+	Sync         SyncCmd          `cmd:"" help:"sync working directory to cloud"`
+	Status       StatusCmd        `cmd:"" help:"show how the working directory differs from the cloud"`
+	Pull         PullCmd          `cmd:"" help:"download files from cloud"`
+	Serve        ServeCmd         `cmd:"" help:"preview the working directory locally, as the cloud would serve it, but uncompressed"`
+	Deploys      DeploysCmd       `cmd:"" help:"deploy history"`
+	Rollback     RollbackCmd      `cmd:"" help:"restore an earlier deploy"`
+	Names        NamesCmd         `cmd:"" help:"efmrl names"`
+	User         UserCmd          `cmd:"" help:"user commands"`
+	Group        GroupCmd         `cmd:"" help:"group commands"`
+	Login        Session          `cmd:"" help:"login commands"`
+	Perms        PermsCmd         `cmd:"" help:"permissions commands"`
 }
 
 // HelloCmd is for "hello world"
 type HelloCmd struct{}
 
 // Run says "hello world", or something like that.
-func (h *HelloCmd) Run(*CLIContext) error {
-	fmt.Println("Hi buddy.")
-	return nil
+func (h *HelloCmd) Run(ctx *CLIContext) error {
+	return ctx.show(map[string]string{"message": "Hi buddy."}, "Hi buddy.", "Hi buddy.")
 }
 
 func main() {
@@ -50,10 +115,42 @@ func main() {
 		"date":    date,
 	})
 
+	// the first signal asks commands to stop; after that, signals kill
+	// efmrl as usual
+	stopCtx, stop := signal.NotifyContext(
+		context.Background(),
+		os.Interrupt,
+		syscall.SIGTERM,
+	)
+	defer stop()
+	go func() {
+		<-stopCtx.Done()
+		stop()
+	}()
+
 	context := &CLIContext{
-		Context: context.Background(),
+		Context: stopCtx,
+		Debug:   cli.Debug,
+		Quiet:   cli.Quiet,
+		Verbose: cli.Verbose,
+		Output:  cli.Output,
+		Log: newLogger(
+			os.Stderr,
+			cli.Quiet,
+			cli.Verbose,
+			cli.Debug,
+			cli.Output == outputJSON,
+		),
+	}
+	slog.SetDefault(context.Log)
+	retryFlags = retryConfig{
+		MaxRetries: cli.Retries,
+		MaxWait:    duration(cli.RetryMaxWait),
 	}
 
 	err := ctx.Run(context)
+	if err != nil && stopCtx.Err() != nil && errors.Is(err, stopCtx.Err()) {
+		err = &exitError{code: exitInterrupted, err: errors.New("interrupted")}
+	}
 	ctx.FatalIfErrorf(err)
 }
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// mountConfig is another local directory to sync, besides RootDir, and the
+// part of the efmrl it is synced to, e.g. "docs/build" to "/docs"
+type mountConfig struct {
+	Local        string `json:"local"`
+	RemotePrefix string `json:"remote_prefix"`
+}
+
+// prefix returns RemotePrefix, cleaned, without leading or trailing slashes
+func (mount *mountConfig) prefix() string {
+	return strings.Trim(path.Clean("/"+mount.RemotePrefix), "/")
+}
+
+// checkMounts makes sure that every mount has a directory and a prefix of
+// its own. RootDir has the top of the efmrl.
+func (cfg *Config) checkMounts() error {
+	locals := map[string]bool{filepath.Clean(cfg.RootDir): true}
+	prefixes := map[string]bool{}
+	for _, mount := range cfg.Mounts {
+		local, prefix := filepath.Clean(mount.Local), mount.prefix()
+		switch {
+		case mount.Local == "":
+			return fmt.Errorf("mount for %q has no local directory", mount.RemotePrefix)
+		case prefix == "":
+			return fmt.Errorf(
+				"mount for %q: remote_prefix is needed; the top of the efmrl is root_dir",
+				mount.Local,
+			)
+		case locals[local]:
+			return fmt.Errorf("%q is mounted more than once", mount.Local)
+		case prefixes[prefix]:
+			return fmt.Errorf("more than one mount for %q", "/"+prefix)
+		}
+		locals[local] = true
+		prefixes[prefix] = true
+	}
+
+	return nil
+}
+
+// mounts returns a Config for each local directory that is synced: cfg
+// itself for RootDir, then one for each mount, whose RootDir, prefix and
+// ignore rules are its own. cfg.skipLen should be set first.
+func (cfg *Config) mounts() []*Config {
+	mounts := []*Config{cfg}
+	for _, mount := range cfg.Mounts {
+		mcfg := *cfg
+		mcfg.RootDir = filepath.Clean(mount.Local)
+		mcfg.prefix = mount.prefix()
+		mcfg.ignore = nil
+		mcfg.Mounts = nil
+		mcfg.nested = cfg.nestedMounts(mcfg.RootDir)
+		if cfg.skipLen > 0 {
+			mcfg.skipLen = len(mcfg.RootDir) + 1 // +1 for '/' separator
+		}
+		mounts = append(mounts, &mcfg)
+	}
+
+	return mounts
+}
+
+// nestedMounts returns the directories under dir, as walking dir finds
+// them, that are RootDir or a mount's. Each is walked as the mount it is, so
+// walking dir skips them: the deepest directory wins, as in localMount.
+func (cfg *Config) nestedMounts(dir string) map[string]bool {
+	top, err := filepath.Abs(dir)
+	if err != nil {
+		return nil
+	}
+	locals := []string{cfg.RootDir}
+	for _, mount := range cfg.Mounts {
+		locals = append(locals, mount.Local)
+	}
+
+	var nested map[string]bool
+	for _, local := range locals {
+		abs, err := filepath.Abs(local)
+		if err != nil || abs == top || !isUnder(abs, top) {
+			continue
+		}
+		rel, err := filepath.Rel(top, abs)
+		if err != nil {
+			continue
+		}
+		if nested == nil {
+			nested = map[string]bool{}
+		}
+		nested[filepath.Join(dir, rel)] = true
+	}
+
+	return nested
+}
+
+// mountFor returns the mount that key, a path in the efmrl, belongs to,
+// and key relative to the mount's prefix. The longest prefix wins; the
+// rest belongs to RootDir.
+func mountFor(mounts []*Config, key string) (*Config, string) {
+	key = strings.TrimPrefix(key, "/")
+	owner, rel := mounts[0], key
+	for _, mcfg := range mounts[1:] {
+		if len(mcfg.prefix) <= len(owner.prefix) {
+			continue
+		}
+		if key == mcfg.prefix {
+			owner, rel = mcfg, ""
+		} else if strings.HasPrefix(key, mcfg.prefix+"/") {
+			owner, rel = mcfg, key[len(mcfg.prefix)+1:]
+		}
+	}
+	if rel == "" {
+		rel = "/"
+	}
+
+	return owner, rel
+}
+
+// localMount returns the mount whose directory holds path, a local path,
+// or nil if none does. The deepest directory wins.
+func localMount(mounts []*Config, path string) *Config {
+	var owner *Config
+	for _, mcfg := range mounts {
+		if owner != nil && len(mcfg.RootDir) <= len(owner.RootDir) {
+			continue
+		}
+		if isUnder(path, mcfg.RootDir) {
+			owner = mcfg
+		}
+	}
+
+	return owner
+}
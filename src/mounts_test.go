@@ -0,0 +1,157 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/efmrl/api2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMounts(t *testing.T) {
+	t.Run("mounts need a directory and a prefix of their own", func(t *testing.T) {
+		assert := assert.New(t)
+
+		type mountCases []struct {
+			mounts []*mountConfig
+			err    string
+		}
+		var cases = mountCases{
+			{mounts: nil},
+			{mounts: []*mountConfig{
+				{Local: "docs/build", RemotePrefix: "/docs"},
+				{Local: "static", RemotePrefix: "assets/"},
+				{Local: "api", RemotePrefix: "docs/api"},
+			}},
+			{
+				mounts: []*mountConfig{{RemotePrefix: "/docs"}},
+				err:    "no local directory",
+			},
+			{
+				mounts: []*mountConfig{{Local: "docs", RemotePrefix: "/"}},
+				err:    "remote_prefix is needed",
+			},
+			{
+				mounts: []*mountConfig{{Local: "dist/", RemotePrefix: "/dist"}},
+				err:    "mounted more than once",
+			},
+			{
+				mounts: []*mountConfig{
+					{Local: "a", RemotePrefix: "/docs"},
+					{Local: "b", RemotePrefix: "docs/"},
+				},
+				err: `more than one mount for "/docs"`,
+			},
+		}
+		for _, c := range cases {
+			cfg := &Config{RootDir: "dist", Mounts: c.mounts}
+			err := cfg.checkMounts()
+			if c.err == "" {
+				assert.NoErrorf(err, "case %#v", c)
+			} else {
+				assert.ErrorContainsf(err, c.err, "case %#v", c)
+			}
+		}
+	})
+	t.Run("paths belong to the longest prefix", func(t *testing.T) {
+		assert := assert.New(t)
+
+		cfg := &Config{
+			RootDir: "dist",
+			Mounts: []*mountConfig{
+				{Local: "docs/build", RemotePrefix: "/docs"},
+				{Local: "api", RemotePrefix: "/docs/api"},
+			},
+			skipLen: len("dist") + 1,
+		}
+		mounts := cfg.mounts()
+		assert.Len(mounts, 3)
+		assert.Same(cfg, mounts[0])
+		assert.Equal("docs", mounts[1].prefix)
+		assert.Equal(len("docs/build")+1, mounts[1].skipLen)
+
+		type ownerCases []struct {
+			key   string
+			owner int
+			rel   string
+		}
+		var cases = ownerCases{
+			{key: "/", owner: 0, rel: "/"},
+			{key: "a.txt", owner: 0, rel: "a.txt"},
+			{key: "docsy/a.txt", owner: 0, rel: "docsy/a.txt"},
+			{key: "docs", owner: 1, rel: "/"},
+			{key: "docs/guide.html", owner: 1, rel: "guide.html"},
+			{key: "/docs/api/v1.html", owner: 2, rel: "v1.html"},
+		}
+		for _, c := range cases {
+			owner, rel := mountFor(mounts, c.key)
+			assert.Samef(mounts[c.owner], owner, "case %#v", c)
+			assert.Equalf(c.rel, rel, "case %#v", c)
+		}
+
+		assert.Same(mounts[0], localMount(mounts, filepath.Join("dist", "a.txt")))
+		assert.Same(mounts[1], localMount(mounts, filepath.Join("docs", "build", "a.html")))
+		assert.Nil(localMount(mounts, filepath.Join("docs", "src", "a.md")))
+	})
+	t.Run("nested mounts are walked once", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		root := t.TempDir()
+		writeTree(t, root, map[string]string{
+			"dist/a.txt":          "a",
+			"dist/docs/b.txt":     "b",
+			"dist/docs/api/c.txt": "c",
+			"dist/other/d.txt":    "d",
+		})
+		cfg := &Config{
+			RootDir: filepath.Join(root, "dist"),
+			Mounts: []*mountConfig{
+				{Local: filepath.Join(root, "dist", "docs"), RemotePrefix: "/manual"},
+				{Local: filepath.Join(root, "dist", "docs", "api"), RemotePrefix: "/api"},
+			},
+		}
+		require.NoError(cfg.prep())
+		cfg.skipLen = len(cfg.RootDir) + 1
+
+		var keys []string
+		for _, mcfg := range cfg.mounts() {
+			err := walkLocal(mcfg, func(string) {}, func(item *workItem) error {
+				keys = append(keys, item.seenKey(mcfg))
+				return nil
+			})
+			require.NoError(err)
+		}
+		assert.ElementsMatch([]string{"a.txt", "other/d.txt", "manual/b.txt", "api/c.txt"}, keys)
+	})
+	t.Run("ignore rules are each mount's own", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		root := t.TempDir()
+		for dir, ignore := range map[string]string{"dist": "*.md\n", "docs": "*.log\n"} {
+			require.NoError(os.MkdirAll(filepath.Join(root, dir), 0777))
+			fpath := filepath.Join(root, dir, ignoreFileName)
+			require.NoError(os.WriteFile(fpath, []byte(ignore), 0666))
+		}
+		cfg := &Config{
+			RootDir: filepath.Join(root, "dist"),
+			Mounts: []*mountConfig{
+				{Local: filepath.Join(root, "docs"), RemotePrefix: "/docs"},
+			},
+		}
+
+		seen := seenMap{}
+		for _, fname := range []string{"a.md", "a.log", "docs/b.md", "docs/b.log"} {
+			p := &atomic.Pointer[api2.FileInfo]{}
+			p.Store(&api2.FileInfo{})
+			seen[fname] = p
+		}
+		stale, err := staleFiles(cfg, seen)
+		require.NoError(err)
+		assert.Equal([]string{"a.log", "docs/b.md"}, stale)
+	})
+}
@@ -1,10 +1,7 @@
 package main
 
 import (
-	"fmt"
 	"net/http/httptest"
-
-	"github.com/efmrl/api2"
 )
 
 type NamesCmd struct {
@@ -22,23 +19,20 @@ func (nl *NamesList) Run(ctx *CLIContext) error {
 	}
 	cfg.ts = nl.ts
 
-	url := cfg.pathToAPIurl("names")
-
-	client, err := cfg.getClient()
+	client, err := cfg.apiClient()
 	if err != nil {
 		return err
 	}
 
-	names := &api2.GetNamesRes{}
-	lnRes := api2.NewResult(names)
-	err = getJSON(client, url, lnRes)
+	names, err := client.ListNames(ctx.stopContext())
 	if err != nil {
 		return err
 	}
 
+	tbl := &table{}
 	for _, name := range names.Names {
-		fmt.Printf("%v\n", name.Name)
+		tbl.add(name.Name)
 	}
 
-	return nil
+	return ctx.showList(names.Names, tbl)
 }
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+// values for the global --output flag
+const (
+	// outputTable is for people: aligned tables, indented JSON and messages
+	outputTable = "table"
+	// outputPlain is for line-oriented tools: one record per line, fields
+	// separated by tabs, and no decoration
+	outputPlain = "plain"
+	// outputJSON is for scripts: JSON documents, or one JSON event per line
+	// for commands like "sync" that report as they go
+	outputJSON = "json"
+)
+
+// stdout returns where results are written
+func (ctx *CLIContext) stdout() io.Writer {
+	if ctx != nil && ctx.Stdout != nil {
+		return ctx.Stdout
+	}
+	return os.Stdout
+}
+
+// chatter returns where progress and other messages are written. With
+// --output json they go to stderr, so that stdout stays parseable.
+func (ctx *CLIContext) chatter() io.Writer {
+	if ctx != nil && ctx.Output == outputJSON {
+		return os.Stderr
+	}
+	return ctx.stdout()
+}
+
+// isJSON reports whether --output json was given
+func (ctx *CLIContext) isJSON() bool {
+	return ctx.Output == outputJSON
+}
+
+// writeJSON writes v to stdout as one line of JSON
+func (ctx *CLIContext) writeJSON(v any) error {
+	ctx.outMu.Lock()
+	defer ctx.outMu.Unlock()
+
+	return json.NewEncoder(ctx.stdout()).Encode(v)
+}
+
+// show writes a single result: v as JSON with --output json, and otherwise
+// text for a table, or plain for plain output.
+func (ctx *CLIContext) show(v any, text, plain string) error {
+	switch ctx.Output {
+	case outputJSON:
+		return ctx.writeJSON(v)
+	case outputPlain:
+		_, err := fmt.Fprintln(ctx.stdout(), plain)
+		return err
+	default:
+		_, err := fmt.Fprintln(ctx.stdout(), text)
+		return err
+	}
+}
+
+// showIndented writes v as indented JSON for a table, or as one line of
+// JSON otherwise. It is for single records, like a user.
+func (ctx *CLIContext) showIndented(v any) error {
+	if ctx.Output != outputTable && ctx.Output != "" {
+		return ctx.writeJSON(v)
+	}
+
+	out, err := json.MarshalIndent(v, "", "    ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(ctx.stdout(), string(out))
+
+	return err
+}
+
+// table is a list of records for showList: rows are aligned by tabwriter
+// for a table, and separated by plain tabs for plain output.
+type table struct {
+	rows [][]string
+}
+
+// add appends a row
+func (tbl *table) add(fields ...any) {
+	row := make([]string, len(fields))
+	for i, field := range fields {
+		row[i] = fmt.Sprint(field)
+	}
+	tbl.rows = append(tbl.rows, row)
+}
+
+// showList writes a list: v as JSON with --output json, and tbl otherwise
+func (ctx *CLIContext) showList(v any, tbl *table) error {
+	out := ctx.stdout()
+	switch ctx.Output {
+	case outputJSON:
+		return ctx.writeJSON(v)
+	case outputPlain:
+		for _, row := range tbl.rows {
+			_, err := fmt.Fprintln(out, strings.Join(row, "\t"))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	tw := tabwriter.NewWriter(out, 0, 2, 1, ' ', 0)
+	for _, row := range tbl.rows {
+		fmt.Fprintf(tw, "%v\t\n", strings.Join(row, "\t "))
+	}
+
+	return tw.Flush()
+}
+
+// fileEvent is one action on one file, as reported by commands like "sync"
+// and "pull": one line of JSON each with --output json, or a line such as
+// "PUT <url>" otherwise.
+type fileEvent struct {
+	Action string `json:"action"` // one of the event* constants
+	Path   string `json:"path"`   // path in the efmrl, starting with '/'
+	URL    string `json:"url,omitempty"`
+	Bytes  int64  `json:"bytes,omitempty"`
+	DryRun bool   `json:"dry_run,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// values for fileEvent.Action
+const (
+	eventPut    = "put"
+	eventSkip   = "skip"
+	eventDelete = "delete"
+	eventGet    = "get"
+	eventError  = "error"
+)
+
+// event reports ev. Only JSON output shows skips and errors; errors are
+// returned as well, so people see them anyway.
+func (ctx *CLIContext) event(ev *fileEvent) {
+	if ctx == nil {
+		return
+	}
+	if ctx.Output == outputJSON {
+		_ = ctx.writeJSON(ev)
+		return
+	}
+	if ctx.Quiet {
+		return
+	}
+
+	switch ev.Action {
+	case eventPut, eventDelete, eventGet:
+		ctx.outMu.Lock()
+		defer ctx.outMu.Unlock()
+		if ctx.live != nil {
+			ctx.live.clear()
+		}
+		fmt.Fprintf(ctx.stdout(), "%v %v\n", strings.ToUpper(ev.Action), ev.URL)
+	}
+}
+
+// efmrlPath turns a seenMap key into a path in the efmrl
+func efmrlPath(key string) string {
+	return "/" + strings.TrimPrefix(key, "/")
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOutput(t *testing.T) {
+	type named struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+	}
+	list := []*named{{"g1", "admins"}, {"g22", "ops"}}
+	tbl := &table{}
+	for _, n := range list {
+		tbl.add(n.ID, n.Name)
+	}
+
+	vectors := []struct {
+		output   string
+		wantList string
+		wantShow string
+	}{
+		{outputTable, "g1   admins \ng22  ops    \n", "new group ID: \"g1\"\n"},
+		{outputPlain, "g1\tadmins\ng22\tops\n", "g1\n"},
+		{
+			outputJSON,
+			`[{"id":"g1","name":"admins"},{"id":"g22","name":"ops"}]` + "\n",
+			`{"id":"g1","name":"admins"}` + "\n",
+		},
+	}
+	for _, v := range vectors {
+		t.Run(v.output, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			out := &bytes.Buffer{}
+			ctx := &CLIContext{Output: v.output, Stdout: out}
+			require.NoError(ctx.showList(list, tbl))
+			assert.Equal(v.wantList, out.String())
+
+			out.Reset()
+			require.NoError(ctx.show(list[0], `new group ID: "g1"`, "g1"))
+			assert.Equal(v.wantShow, out.String())
+		})
+	}
+}
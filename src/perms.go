@@ -3,10 +3,7 @@ package main
 import (
 	"fmt"
 	"io"
-	"net/http"
 	"net/http/httptest"
-	"net/url"
-	"os"
 	"strings"
 	"text/tabwriter"
 
@@ -36,21 +33,24 @@ func (pl *PermsListCmd) Run(ctx *CLIContext) error {
 	}
 	cfg.ts = pl.ts
 
-	url := cfg.pathToAPIurl("perms")
-
-	client, err := cfg.getClient()
+	client, err := cfg.apiClient()
 	if err != nil {
 		return err
 	}
 
-	allPerms := &api2.AllPerms{}
-	apiRes := api2.NewResult(allPerms)
-	err = getJSON(client, url, apiRes)
+	allPerms, err := client.ListPerms(ctx.stopContext())
 	if err != nil {
 		return err
 	}
 
-	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 4, ' ', tabwriter.AlignRight)
+	switch ctx.Output {
+	case outputJSON:
+		return ctx.writeJSON(allPerms)
+	case outputPlain:
+		return ctx.showList(allPerms, plainPerms(allPerms))
+	}
+
+	tw := tabwriter.NewWriter(ctx.stdout(), 0, 4, 4, ' ', tabwriter.AlignRight)
 
 	if allPerms.Efmrl != nil {
 		showSpecialPerms(tw, "efmrl", allPerms.Efmrl)
@@ -97,14 +97,63 @@ func showSpecialPerms(out io.Writer, name string, spec *api2.SpecialPerms) {
 
 }
 
+// plainPerms returns a row per scope and class, then a row per user
+func plainPerms(allPerms *api2.AllPerms) *table {
+	tbl := &table{}
+	addSpecials := func(name string, spec *api2.SpecialPerms) {
+		tbl.add(name, "everyone", showPerms(spec.Everyone))
+		tbl.add(name, "sessioned", showPerms(spec.Sessioned))
+		tbl.add(name, "authenticated", showPerms(spec.Authenticated))
+	}
+	if allPerms.Efmrl != nil {
+		addSpecials("efmrl", allPerms.Efmrl)
+	}
+	for path, mnt := range allPerms.Mounts {
+		addSpecials(path, mnt.Specials)
+	}
+	for _, user := range allPerms.Users {
+		name := user.Name
+		if name == "" {
+			name = user.ID
+		}
+		tbl.add(name, "user", showPerms(&user.Perms))
+	}
+
+	return tbl
+}
+
 type PermsDefineCmd struct {
 }
 
-func (pd *PermsDefineCmd) Run() error {
+// permDefinition is one permission, for "perms define --output json"
+type permDefinition struct {
+	Name       string `json:"name"`
+	Definition string `json:"definition"`
+}
+
+func (pd *PermsDefineCmd) Run(ctx *CLIContext) error {
+	var defs []*permDefinition
 	for _, perm := range api2.PermSimplePerms() {
 		val := api2.PermNameValue[perm]
-		perm = strings.TrimPrefix(perm, "Perm")
-		fmt.Printf("%14v - %v\n", perm, api2.PermShortDefinitions[val])
+		defs = append(defs, &permDefinition{
+			Name:       strings.TrimPrefix(perm, "Perm"),
+			Definition: api2.PermShortDefinitions[val],
+		})
+	}
+
+	switch ctx.Output {
+	case outputJSON:
+		return ctx.writeJSON(defs)
+	case outputPlain:
+		tbl := &table{}
+		for _, def := range defs {
+			tbl.add(def.Name, def.Definition)
+		}
+		return ctx.showList(defs, tbl)
+	}
+
+	for _, def := range defs {
+		fmt.Fprintf(ctx.stdout(), "%14v - %v\n", def.Name, def.Definition)
 	}
 
 	return nil
@@ -127,9 +176,7 @@ func (pees *PermsEfmrlEveryoneSet) Run(ctx *CLIContext) error {
 	}
 	cfg.ts = pees.ts
 
-	url := cfg.pathToAPIurl("perms/data")
-
-	client, err := cfg.getClient()
+	client, err := cfg.apiClient()
 	if err != nil {
 		return err
 	}
@@ -144,15 +191,14 @@ func (pees *PermsEfmrlEveryoneSet) Run(ctx *CLIContext) error {
 			Everyone: &perms,
 		},
 	}
-	res, err := patchJSON(ctx.Context, client, url, allPerms, nil)
+	err = client.PatchDataPerms(ctx.stopContext(), allPerms)
 	if err != nil {
 		return err
 	}
-	if res.StatusCode >= 300 {
-		return fmt.Errorf("failed: %v", res.Status)
-	}
 
-	fmt.Println("done")
+	if !ctx.Quiet {
+		fmt.Fprintln(ctx.chatter(), "done")
+	}
 
 	return nil
 }
@@ -170,16 +216,13 @@ func (pgoa *PermsGrantAll) Run(ctx *CLIContext) error {
 	}
 	cfg.ts = pgoa.ts
 
-	client, err := cfg.getClient()
+	client, err := cfg.apiClient()
 	if err != nil {
 		return err
 	}
-	var url *url.URL
 	userID := pgoa.User
 	if userID == "" {
-		url = cfg.pathToAPIurl("session")
-		ses := &api2.SessionRes{}
-		err = getJSON(client, url, api2.NewResult(ses))
+		ses, err := client.Session(ctx.stopContext())
 		if err != nil {
 			err = fmt.Errorf("cannot get login session: %w", err)
 			return err
@@ -187,7 +230,6 @@ func (pgoa *PermsGrantAll) Run(ctx *CLIContext) error {
 		userID = ses.UserID
 	}
 
-	url = cfg.pathToAPIurl("perms")
 	ap := &api2.AllPerms{
 		Users: map[string]*api2.User{
 			userID: &api2.User{
@@ -195,15 +237,11 @@ func (pgoa *PermsGrantAll) Run(ctx *CLIContext) error {
 			},
 		},
 	}
-	resp, err := patchJSON(ctx.Context, client, url, ap, nil)
+	err = client.PatchPerms(ctx.stopContext(), ap)
 	if err != nil {
 		err = fmt.Errorf("cannot grant permissions: %w", err)
 		return err
 	}
-	if resp.StatusCode != http.StatusOK {
-		err = fmt.Errorf("cannot grant permissions: %q", resp.Status)
-		return err
-	}
 
 	return nil
 }
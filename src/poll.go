@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"io/fs"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// poller finds changes under RootDir, the mounts, and any other roots, by
+// walking them every so often, for file systems that don't send events,
+// like network file systems and some container mounts. It sends the same
+// events a watcher would for files, but none for directories.
+type poller struct {
+	mounts   []*Config // RootDir and the mounts
+	roots    []string  // the mounts' directories first
+	interval time.Duration
+	files    map[string]fileStamp // as of the latest walk
+
+	events chan fsnotify.Event
+	errors chan error
+}
+
+// fileStamp is what a file looked like when it was last walked
+type fileStamp struct {
+	size    int64
+	modTime time.Time
+	mode    fs.FileMode
+}
+
+func newPoller(cfg *Config, interval time.Duration, roots ...string) (*poller, error) {
+	p := &poller{
+		mounts:   cfg.mounts(),
+		interval: interval,
+		events:   make(chan fsnotify.Event),
+		errors:   make(chan error),
+	}
+	for _, mcfg := range p.mounts {
+		p.roots = append(p.roots, mcfg.RootDir)
+	}
+	p.roots = append(p.roots, roots...)
+	files, err := p.scan()
+	if err != nil {
+		return nil, err
+	}
+	p.files = files
+
+	return p, nil
+}
+
+// run polls until ctx is done
+func (p *poller) run(ctx context.Context) {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	lastErr := "" // so that an error that lasts is sent once
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		files, err := p.scan()
+		if err != nil && err.Error() == lastErr {
+			continue
+		}
+		if err != nil {
+			lastErr = err.Error()
+			select {
+			case p.errors <- err:
+			case <-ctx.Done():
+				return
+			}
+			continue
+		}
+		lastErr = ""
+		for _, event := range p.diff(files) {
+			select {
+			case p.events <- event:
+			case <-ctx.Done():
+				return
+			}
+		}
+		p.files = files
+	}
+}
+
+// scan walks the roots, skipping ignored directories under RootDir and
+// the mounts
+func (p *poller) scan() (map[string]fileStamp, error) {
+	files := map[string]fileStamp{}
+	for i, root := range p.roots {
+		var cfg *Config
+		if i < len(p.mounts) {
+			cfg = p.mounts[i]
+		}
+		if err := p.scanRoot(files, root, cfg); err != nil {
+			return nil, err
+		}
+	}
+
+	return files, nil
+}
+
+// scanRoot adds the files under root to files. If cfg is set, root is its
+// RootDir, and directories it ignores, and other mounts, are skipped.
+func (p *poller) scanRoot(files map[string]fileStamp, root string, cfg *Config) error {
+	skipLen := len(root) + 1
+	return filepath.WalkDir(root, func(
+		path string,
+		d fs.DirEntry,
+		err error,
+	) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if cfg != nil && cfg.nested[path] {
+				return filepath.SkipDir
+			}
+			if cfg != nil && len(path) > skipLen {
+				skip, err := cfg.ignored(path[skipLen:], true)
+				if err != nil {
+					return err
+				}
+				if skip {
+					return filepath.SkipDir
+				}
+			}
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		files[path] = fileStamp{
+			size:    info.Size(),
+			modTime: info.ModTime(),
+			mode:    info.Mode(),
+		}
+
+		return nil
+	})
+}
+
+// diff returns events for the changes from the latest walk to files
+func (p *poller) diff(files map[string]fileStamp) []fsnotify.Event {
+	var events []fsnotify.Event
+	for path, stamp := range files {
+		old, ok := p.files[path]
+		switch {
+		case !ok:
+			events = append(events, fsnotify.Event{Name: path, Op: fsnotify.Create})
+		case old != stamp:
+			events = append(events, fsnotify.Event{Name: path, Op: fsnotify.Write})
+		}
+	}
+	for path := range p.files {
+		if _, ok := files[path]; !ok {
+			events = append(events, fsnotify.Event{Name: path, Op: fsnotify.Remove})
+		}
+	}
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].Name < events[j].Name
+	})
+
+	return events
+}
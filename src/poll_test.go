@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPoller(t *testing.T) {
+	goBack, err := cdTmp(t)
+	require.NoError(t, err)
+	defer goBack()
+
+	writeTree(t, "site", map[string]string{
+		"a.txt":        "a",
+		"b.txt":        "b",
+		"sub/c.txt":    "c",
+		"skip/x.txt":   "ignored",
+		ignoreFileName: "skip/\n",
+	})
+	cfg := &Config{RootDir: "site"}
+
+	t.Run("changes become events", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		p, err := newPoller(cfg, time.Hour)
+		require.NoError(err)
+		assert.NotContains(p.files, "site/skip/x.txt")
+
+		writeTree(t, "site", map[string]string{
+			"a.txt":      "changed",
+			"d.txt":      "new",
+			"skip/y.txt": "ignored",
+		})
+		require.NoError(os.RemoveAll("site/sub"))
+		files, err := p.scan()
+		require.NoError(err)
+		assert.Equal([]fsnotify.Event{
+			{Name: "site/a.txt", Op: fsnotify.Write},
+			{Name: "site/d.txt", Op: fsnotify.Create},
+			{Name: "site/sub/c.txt", Op: fsnotify.Remove},
+		}, p.diff(files))
+	})
+
+	t.Run("run sends events and errors", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		p, err := newPoller(cfg, 10*time.Millisecond)
+		require.NoError(err)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go p.run(ctx)
+
+		writeTree(t, "site", map[string]string{"e.txt": "e"})
+		select {
+		case event := <-p.events:
+			assert.Equal(fsnotify.Event{Name: "site/e.txt", Op: fsnotify.Create}, event)
+		case <-time.After(5 * time.Second):
+			assert.Fail("no event")
+		}
+
+		// a missing RootDir is an error, but polling goes on
+		require.NoError(os.Rename("site", "gone"))
+		select {
+		case err := <-p.errors:
+			assert.ErrorIs(err, os.ErrNotExist)
+		case <-time.After(5 * time.Second):
+			assert.Fail("no error")
+		}
+		require.NoError(os.Rename("gone", "site"))
+		writeTree(t, "site", map[string]string{"f.txt": "f"})
+		timeout := time.After(5 * time.Second)
+		for event := (fsnotify.Event{}); event.Name == ""; {
+			select {
+			case event = <-p.events:
+				assert.Equal("site/f.txt", event.Name)
+			case <-p.errors:
+				// from a walk before the rename back
+			case <-timeout:
+				require.Fail("no event")
+			}
+		}
+	})
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// progressInterval is how often the progress display is redrawn
+	progressInterval = 200 * time.Millisecond
+	// progressBarWidth is the width of the bar, in characters
+	progressBarWidth = 24
+	// progressPathWidth is how much of each worker's path is shown, so
+	// lines don't wrap and throw off the redraw
+	progressPathWidth = 60
+)
+
+// liveDisplay is drawn in place at the bottom of the terminal. Lines that
+// event writes go above it.
+type liveDisplay interface {
+	// clear erases the display; it is redrawn on its next tick
+	clear()
+}
+
+// isTerminal reports whether f is a terminal, not a file or pipe
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// syncProgress counts what a sync has done, and shows it as it goes. A nil
+// *syncProgress counts nothing.
+type syncProgress struct {
+	start time.Time
+
+	files  atomic.Int64 // queued by the walk
+	bytes  atomic.Int64 // in queued files
+	walked atomic.Bool  // the walk is over, so files and bytes are known
+
+	doneFiles atomic.Int64 // pushed, skipped or failed
+	doneBytes atomic.Int64 // in done files
+	sent      atomic.Int64 // bytes actually sent, after compression
+
+	pushed  atomic.Int64
+	skipped atomic.Int64
+	deleted atomic.Int64
+	failed  atomic.Int64
+
+	mu      sync.Mutex
+	current map[int]string // each worker's file
+	out     io.Writer      // the terminal, while displaying
+	lines   int            // how many lines were drawn last
+}
+
+func newSyncProgress() *syncProgress {
+	return &syncProgress{
+		start:   time.Now(),
+		current: map[int]string{},
+	}
+}
+
+// queue counts a file found by the walk
+func (sp *syncProgress) queue(size int64) {
+	if sp == nil {
+		return
+	}
+	sp.files.Add(1)
+	sp.bytes.Add(size)
+}
+
+// walkDone notes that every file has been queued
+func (sp *syncProgress) walkDone() {
+	if sp == nil {
+		return
+	}
+	sp.walked.Store(true)
+}
+
+// working notes which file a worker is on; "" when it's idle
+func (sp *syncProgress) working(worker int, path string) {
+	if sp == nil {
+		return
+	}
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	if path == "" {
+		delete(sp.current, worker)
+		return
+	}
+	sp.current[worker] = path
+}
+
+// done counts a file that is finished with, as the event says. Failures
+// are counted by whoever decides what to do about them.
+func (sp *syncProgress) done(ev *fileEvent, size int64) {
+	if sp == nil {
+		return
+	}
+	switch ev.Action {
+	case eventPut:
+		sp.pushed.Add(1)
+	case eventSkip:
+		sp.skipped.Add(1)
+	}
+	sp.doneFiles.Add(1)
+	sp.doneBytes.Add(size)
+}
+
+// reader returns r, counting the bytes read from it as sent
+func (sp *syncProgress) reader(r io.Reader) io.Reader {
+	if sp == nil {
+		return r
+	}
+	return &countingReader{r: r, count: &sp.sent}
+}
+
+// unsend takes back what r, from reader, counted as sent, for when a
+// failed request is retried and sends it all again
+func (sp *syncProgress) unsend(r io.Reader) {
+	if cr, ok := r.(*countingReader); ok {
+		cr.count.Add(-cr.read.Swap(0))
+	}
+}
+
+type countingReader struct {
+	r     io.Reader
+	count *atomic.Int64
+	read  atomic.Int64 // by this reader, to take back on a retry
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.read.Add(int64(n))
+	cr.count.Add(int64(n))
+	return n, err
+}
+
+// display draws the progress on out, which should be a terminal, until the
+// returned function is first called
+func (sp *syncProgress) display(ctx *CLIContext, out io.Writer) func() {
+	ctx.outMu.Lock()
+	sp.out = out
+	ctx.live = sp
+	ctx.outMu.Unlock()
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(progressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				ctx.outMu.Lock()
+				sp.draw()
+				ctx.outMu.Unlock()
+			}
+		}
+	}()
+
+	return sync.OnceFunc(func() {
+		close(stop)
+		<-done
+		ctx.outMu.Lock()
+		defer ctx.outMu.Unlock()
+		sp.clear()
+		ctx.live = nil
+	})
+}
+
+// clear erases what draw drew; the caller holds the CLIContext's outMu
+func (sp *syncProgress) clear() {
+	if sp.lines > 0 {
+		// to the start of the first line drawn, then erase to the end
+		fmt.Fprintf(sp.out, "\x1b[%dF\x1b[J", sp.lines)
+		sp.lines = 0
+	}
+}
+
+// draw redraws the display; the caller holds the CLIContext's outMu
+func (sp *syncProgress) draw() {
+	lines := append([]string{sp.overall()}, sp.workers()...)
+	sp.clear()
+	for _, line := range lines {
+		fmt.Fprintln(sp.out, line)
+	}
+	sp.lines = len(lines)
+}
+
+// overall is the line with the bar, counts, throughput and ETA
+func (sp *syncProgress) overall() string {
+	files, bytes := sp.files.Load(), sp.bytes.Load()
+	doneFiles, doneBytes := sp.doneFiles.Load(), sp.doneBytes.Load()
+	elapsed := time.Since(sp.start)
+
+	fraction := 0.0
+	if bytes > 0 {
+		fraction = float64(doneBytes) / float64(bytes)
+	} else if files > 0 {
+		fraction = float64(doneFiles) / float64(files)
+	}
+	filled := min(int(fraction*progressBarWidth), progressBarWidth)
+	bar := strings.Repeat("#", filled) + strings.Repeat("-", progressBarWidth-filled)
+
+	eta := "?"
+	if sp.walked.Load() && doneBytes > 0 {
+		perByte := float64(elapsed) / float64(doneBytes)
+		remaining := time.Duration(perByte * float64(bytes-doneBytes))
+		eta = remaining.Round(time.Second).String()
+	}
+
+	return fmt.Sprintf(
+		"[%v] %v/%v files  %v/%v  %v/s  ETA %v",
+		bar,
+		doneFiles,
+		files,
+		formatBytes(doneBytes),
+		formatBytes(bytes),
+		formatBytes(int64(float64(sp.sent.Load())/max(elapsed.Seconds(), 0.001))),
+		eta,
+	)
+}
+
+// workers is a line per busy worker, with the file it's on
+func (sp *syncProgress) workers() []string {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+
+	ids := make([]int, 0, len(sp.current))
+	for id := range sp.current {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	lines := make([]string, 0, len(ids))
+	for _, id := range ids {
+		path := sp.current[id]
+		if len(path) > progressPathWidth {
+			path = "..." + path[len(path)-progressPathWidth+3:]
+		}
+		lines = append(lines, fmt.Sprintf("  %2d: %v", id+1, path))
+	}
+
+	return lines
+}
+
+// syncSummary is shown when a sync ends
+type syncSummary struct {
+	Action   string  `json:"action"` // always "summary", unlike file events
+	Uploaded int64   `json:"uploaded"`
+	Skipped  int64   `json:"skipped"` // unchanged
+	Deleted  int64   `json:"deleted"`
+	Failed   int64   `json:"failed"`
+	Bytes    int64   `json:"bytes"` // sent, after compression
+	Elapsed  float64 `json:"elapsed_seconds"`
+}
+
+// summary returns the totals so far
+func (sp *syncProgress) summary() *syncSummary {
+	return &syncSummary{
+		Action:   "summary",
+		Uploaded: sp.pushed.Load(),
+		Skipped:  sp.skipped.Load(),
+		Deleted:  sp.deleted.Load(),
+		Failed:   sp.failed.Load(),
+		Bytes:    sp.sent.Load(),
+		Elapsed:  time.Since(sp.start).Seconds(),
+	}
+}
+
+// showSyncSummary shows the totals: a line of JSON with --output json, and
+// a line of text unless quiet
+func (ctx *CLIContext) showSyncSummary(summary *syncSummary) error {
+	if ctx.isJSON() {
+		return ctx.writeJSON(summary)
+	}
+	if ctx.Quiet {
+		return nil
+	}
+
+	elapsed := time.Duration(summary.Elapsed * float64(time.Second))
+	_, err := fmt.Fprintf(
+		ctx.chatter(),
+		"uploaded %v, unchanged %v, deleted %v, failed %v; %v in %v\n",
+		summary.Uploaded,
+		summary.Skipped,
+		summary.Deleted,
+		summary.Failed,
+		formatBytes(summary.Bytes),
+		elapsed.Round(10*time.Millisecond),
+	)
+	return err
+}
+
+// formatBytes formats n for people, e.g. "1.5MiB"
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%vB", n)
+	}
+	value, prefix := float64(n)/unit, 0
+	for value >= unit && prefix < 3 {
+		value /= unit
+		prefix++
+	}
+
+	return fmt.Sprintf("%.1f%ciB", value, "KMGT"[prefix])
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProgress(t *testing.T) {
+	t.Run("display", func(t *testing.T) {
+		assert := assert.New(t)
+
+		sp := newSyncProgress()
+		sp.queue(1000)
+		sp.queue(3000)
+		sp.walkDone()
+		sp.done(&fileEvent{Action: eventSkip}, 1000)
+		sp.working(0, "/css/site.css")
+		sp.working(3, "/"+strings.Repeat("x", 100))
+
+		term := &bytes.Buffer{}
+		sp.out = term
+		sp.draw()
+		lines := strings.Split(strings.TrimSuffix(term.String(), "\n"), "\n")
+		assert.Len(lines, 3)
+		assert.Contains(lines[0], "[######------------------] 1/2 files")
+		assert.Contains(lines[0], "1000B/3.9KiB")
+		assert.Equal("   1: /css/site.css", lines[1])
+		assert.Equal("   4: ..."+strings.Repeat("x", progressPathWidth-3), lines[2])
+
+		// redrawing first erases the lines drawn before
+		term.Reset()
+		sp.working(3, "")
+		sp.draw()
+		assert.True(strings.HasPrefix(term.String(), "\x1b[3F\x1b[J"))
+		assert.Equal(2, sp.lines)
+
+		// events clear the display to write above it
+		term.Reset()
+		out := &bytes.Buffer{}
+		ctx := &CLIContext{Stdout: out, live: sp}
+		ctx.event(&fileEvent{Action: eventPut, URL: "https://x/a"})
+		assert.Equal("\x1b[2F\x1b[J", term.String())
+		assert.Equal("PUT https://x/a\n", out.String())
+		assert.Zero(sp.lines)
+	})
+
+	t.Run("counts", func(t *testing.T) {
+		assert := assert.New(t)
+
+		sp := newSyncProgress()
+		sp.done(&fileEvent{Action: eventPut}, 10)
+		sp.done(&fileEvent{Action: eventPut}, 10)
+		sp.done(&fileEvent{Action: eventSkip}, 10)
+		sp.done(&fileEvent{Action: eventError}, 10)
+		sp.failed.Add(1)
+		sp.deleted.Add(3)
+		_, _ = sp.reader(strings.NewReader("12345")).Read(make([]byte, 10))
+
+		// a retry takes back what the failed attempt sent
+		r := sp.reader(strings.NewReader("abc"))
+		_, _ = r.Read(make([]byte, 2))
+		sp.unsend(r)
+		sp.unsend(r)
+
+		summary := sp.summary()
+		assert.Equal(int64(2), summary.Uploaded)
+		assert.Equal(int64(1), summary.Skipped)
+		assert.Equal(int64(1), summary.Failed)
+		assert.Equal(int64(3), summary.Deleted)
+		assert.Equal(int64(5), summary.Bytes)
+
+		var none *syncProgress
+		none.done(&fileEvent{Action: eventPut}, 10)
+		r = strings.NewReader("")
+		assert.Same(r, none.reader(r))
+		none.unsend(r)
+	})
+
+	t.Run("bytes", func(t *testing.T) {
+		assert := assert.New(t)
+
+		for n, want := range map[int64]string{
+			0:             "0B",
+			1023:          "1023B",
+			1024:          "1.0KiB",
+			1536:          "1.5KiB",
+			5 << 20:       "5.0MiB",
+			3 << 30:       "3.0GiB",
+			5000 << 30:    "4.9TiB",
+			5000000 << 30: "4882.8TiB",
+		} {
+			assert.Equal(want, formatBytes(n), n)
+		}
+	})
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// PullCmd downloads the efmrl's files
+type PullCmd struct {
+	Dir      string `arg:"" optional:"" help:"directory to download into; default is the root directory, and each mount's directory for files under its prefix"`
+	DryRun   bool   `short:"n" help:"show files that would be downloaded without downloading them"`
+	Force    bool   `short:"f" help:"download even if the local file is unchanged"`
+	CrossFS  bool   `short:"X" help:"cross filesystem mounts within the efmrl"`
+	Parallel int    `default:"4" short:"p" help:"how many files to download at once"`
+	MaxFiles int    `hidden:""`
+
+	ts *httptest.Server
+}
+
+// pullItem is a remote file, and where it goes locally
+type pullItem struct {
+	remote string   // path in the efmrl, without the leading '/'
+	local  string   // local path, if it's not a rewritten index file
+	dir    string   // local directory, if it may be a rewritten index file
+	etag   string   // server's ETag
+	size   int64    // server's size in bytes
+	names  []string // index file names to try, if dir is set
+}
+
+// Run the "pull" subcommand
+func (pull *PullCmd) Run(ctx *CLIContext) error {
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	cfg.ts = pull.ts
+	msg, err := loggedIn(ctx.stopContext(), cfg)
+	if err != nil {
+		return err
+	}
+	if msg != "" {
+		fmt.Fprintln(ctx.chatter(), msg)
+		return nil
+	}
+
+	return pull.pull(ctx, cfg)
+}
+
+func (pull *PullCmd) pull(ctx *CLIContext, cfg *Config) error {
+	if pull.Dir == "" && cfg.RootDir == "" {
+		return fmt.Errorf("no directory given, and no root directory is set")
+	}
+
+	seen := seenMap{}
+	err := setSeenMap(cfg, ctx, seen, pull.MaxFiles, pull.CrossFS)
+	if err != nil {
+		return err
+	}
+
+	var hashes *hashCache
+	if !pull.Force {
+		hashes, err = loadHashCache(cfg, false)
+		if err != nil {
+			return err
+		}
+	}
+
+	items, err := pullItems(cfg, pull.Dir, seen)
+	if err != nil {
+		return err
+	}
+
+	cfgCopy := *cfg
+	cfgCopy.skipLen = 0
+
+	// one client for all the downloads, so that connections are reused,
+	// and since getting it may load the global config into cfg
+	client, err := cfg.getClient()
+	if err != nil {
+		return err
+	}
+	g, gctx := errgroup.WithContext(ctx.stopContext())
+	g.SetLimit(max(pull.Parallel, 1))
+	for _, item := range items {
+		g.Go(func() error {
+			if err := gctx.Err(); err != nil {
+				return err
+			}
+			same, err := item.unchanged(hashes)
+			if err != nil {
+				return err
+			}
+			url := cfgCopy.pathToURL("", item.remote)
+			event := &fileEvent{
+				Action: eventGet,
+				Path:   efmrlPath(item.remote),
+				URL:    url.String(),
+				Bytes:  item.size,
+				DryRun: pull.DryRun,
+			}
+			if same {
+				event.Action = eventSkip
+				ctx.event(event)
+				return nil
+			}
+			if pull.DryRun {
+				ctx.event(event)
+				return nil
+			}
+
+			err = item.get(gctx, client, url.String(), hashes)
+			if err != nil {
+				err = fmt.Errorf("cannot pull %q: %w", item.remote, err)
+				event.Action = eventError
+				event.Error = err.Error()
+				ctx.event(event)
+				return err
+			}
+			ctx.event(event)
+			return nil
+		})
+	}
+	err = g.Wait()
+
+	if saveErr := hashes.save(); saveErr != nil && err == nil {
+		err = saveErr
+	}
+
+	return err
+}
+
+// pullItems decides where each remote file goes: under target, or if that
+// is "", under RootDir or the mount whose prefix it is under. A remote path
+// is a rewritten index file if it is the root or if other files are below
+// it. If it has no extension and some index file is configured to be
+// rewritten, it may be one; that is settled by its content type.
+func pullItems(cfg *Config, target string, seen seenMap) ([]*pullItem, error) {
+	dirs := map[string]bool{}
+	for remote := range seen {
+		for dir := path.Dir(remote); dir != "." && dir != "/"; dir = path.Dir(dir) {
+			dirs[dir] = true
+		}
+	}
+
+	var names []string
+	for name := range cfg.indexRewrite {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	mounts := cfg.mounts()
+	items := make([]*pullItem, 0, len(seen))
+	for remote, p := range seen {
+		fi := p.Load()
+		remote = strings.TrimPrefix(remote, "/")
+		item := &pullItem{
+			remote: remote,
+			etag:   fi.ETAG,
+			size:   int64(fi.Bytes),
+		}
+
+		dir, rel := target, remote
+		if target == "" {
+			var mcfg *Config
+			mcfg, rel = mountFor(mounts, remote)
+			dir = mcfg.RootDir
+		}
+		local, err := localPathFor(dir, rel)
+		if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case remote == "" || dirs[remote]:
+			item.dir = local
+			item.names = names
+			if len(names) == 0 {
+				item.names = []string{"index.html"}
+			}
+		case path.Ext(remote) == "" && len(names) > 0:
+			// decided by content type once downloaded
+			item.local = local
+			item.dir = local
+			item.names = names
+		default:
+			item.local = local
+		}
+
+		items = append(items, item)
+	}
+
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].remote < items[j].remote
+	})
+
+	return items, nil
+}
+
+// localPathFor joins target and remote, refusing paths that would land
+// outside of target.
+func localPathFor(target, remote string) (string, error) {
+	local := filepath.Join(target, filepath.FromSlash(remote))
+	rel, err := filepath.Rel(target, local)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("remote path %q is outside of %q", remote, target)
+	}
+
+	return local, nil
+}
+
+// unchanged reports whether the local copy of the item matches the server
+func (item *pullItem) unchanged(hashes *hashCache) (bool, error) {
+	if hashes == nil {
+		return false, nil
+	}
+
+	var candidates []string
+	if item.local != "" {
+		candidates = append(candidates, item.local)
+	}
+	if item.dir != "" {
+		for _, name := range item.names {
+			candidates = append(candidates, filepath.Join(item.dir, name))
+		}
+	}
+
+	for _, local := range candidates {
+		info, err := os.Stat(local)
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		if stored := hashes.stored(local, info); stored != "" && stored == item.etag {
+			return true, nil
+		}
+		if item.size > 0 && info.Size() != item.size {
+			continue
+		}
+		_, same, err := hashes.matchETag(local, item.etag, info)
+		if err != nil {
+			return false, err
+		}
+		if same {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// get downloads the item from url. For rewritten index files, the local file
+// name is the index name whose type matches the response. Files that the
+// server keeps compressed are decoded, and their ETag noted in hashes, since
+// it is of the compressed bytes.
+func (item *pullItem) get(
+	ctx context.Context,
+	client *http.Client,
+	url string,
+	hashes *hashCache,
+) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return err
+	}
+	// asking for the encodings ourselves keeps the transport from decoding
+	// gzip on its own, so that every encoding is handled alike
+	req.Header.Set("Accept-Encoding", "gzip, br")
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("received status %v", res.Status)
+	}
+	body := io.Reader(res.Body)
+	encoding := res.Header.Get(contentEncodingHeader)
+	if encoding == "identity" {
+		encoding = ""
+	}
+	if encoding != "" {
+		decode := decoders[encoding]
+		if decode == nil {
+			return fmt.Errorf("unknown Content-Encoding %q", encoding)
+		}
+		body, err = decode(res.Body)
+		if err != nil {
+			return err
+		}
+	}
+
+	local := item.local
+	if item.dir != "" {
+		name, ok := indexNameFor(item.names, res.Header.Get(contentTypeHeader))
+		switch {
+		case ok:
+			local = filepath.Join(item.dir, name)
+		case local == "":
+			local = filepath.Join(item.dir, item.names[0])
+		}
+	}
+
+	err = os.MkdirAll(filepath.Dir(local), 0777)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(local), "."+filepath.Base(local)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = io.Copy(tmp, body)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+	err = os.Chmod(tmp.Name(), 0644)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp.Name(), local)
+	if err != nil || encoding == "" {
+		return err
+	}
+
+	info, err := os.Stat(local)
+	if err != nil {
+		return err
+	}
+	hashes.setStored(local, info, item.etag)
+
+	return nil
+}
+
+// indexNameFor returns the index file name whose extension matches
+// contentType, if there is one.
+func indexNameFor(names []string, contentType string) (string, bool) {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	for _, name := range names {
+		extType, _, _ := mime.ParseMediaType(mime.TypeByExtension(path.Ext(name)))
+		if extType != "" && extType == mediaType {
+			return name, true
+		}
+	}
+
+	return "", false
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/efmrl/api2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPull(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	goBack, err := cdTmp(t)
+	require.NoError(err)
+	defer goBack()
+	cleanup, err := fakeHome(t)
+	require.NoError(err)
+	defer cleanup()
+
+	// files pushed compressed are kept that way
+	compressed := func(encoding, contents string) string {
+		buf := &bytes.Buffer{}
+		w, err := encoders[encoding](buf)
+		require.NoError(err)
+		_, err = io.WriteString(w, contents)
+		require.NoError(err)
+		require.NoError(w.Close())
+		return buf.String()
+	}
+	bundle := strings.Repeat("console.log('hello');\n", 100)
+	encodings := map[string]string{"/js/bundle.js": "gzip", "/data.json": "br"}
+	files := map[string]string{
+		"/":             "<h1>home</h1>",
+		"/docs":         "<h1>docs</h1>",
+		"/docs/a.css":   "body {}",
+		"/blog/post":    "<h1>post</h1>",
+		"/LICENSE":      "do what you like",
+		"/js/app.js":    "alert(1)",
+		"/js/bundle.js": compressed("gzip", bundle),
+		"/data.json":    compressed("br", `{"a": 1}`),
+	}
+	var gets atomic.Int32
+	f := func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" {
+			res := &api2.ListFilesRes{Files: map[string]*api2.FileInfo{}}
+			for fname, contents := range files {
+				sum := md5.Sum([]byte(contents))
+				res.Files[fname] = &api2.FileInfo{
+					ETAG:  hex.EncodeToString(sum[:]),
+					Bytes: len(contents),
+				}
+			}
+			_ = json.NewEncoder(w).Encode(api2.NewSuccessAny(res))
+			return
+		}
+
+		gets.Add(1)
+		fname := r.URL.Path
+		contents, ok := files[fname]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		switch {
+		case strings.HasPrefix(contents, "<h1>"):
+			w.Header().Set(contentTypeHeader, "text/html; charset=utf-8")
+		default:
+			w.Header().Set(contentTypeHeader, "text/plain; charset=utf-8")
+		}
+		if encoding := encodings[fname]; encoding != "" {
+			w.Header().Set(contentEncodingHeader, encoding)
+		}
+		_, _ = w.Write([]byte(contents))
+	}
+	ts := httptest.NewTLSServer(http.HandlerFunc(f))
+	defer ts.Close()
+
+	cfg := &Config{
+		Efmrl:        "pull-up",
+		CanonURL:     ts.URL,
+		RootDir:      "site",
+		indexRewrite: map[string]bool{"index.html": true},
+		ts:           ts,
+	}
+	require.NoError(cfg.prep())
+
+	pull := &PullCmd{Parallel: 3}
+	ctx := &CLIContext{Quiet: true}
+	err = pull.pull(ctx, cfg)
+	require.NoError(err)
+
+	want := map[string]string{
+		"index.html":           "<h1>home</h1>",
+		"docs/index.html":      "<h1>docs</h1>",
+		"docs/a.css":           "body {}",
+		"blog/post/index.html": "<h1>post</h1>",
+		"LICENSE":              "do what you like",
+		"js/app.js":            "alert(1)",
+		"js/bundle.js":         bundle,
+		"data.json":            `{"a": 1}`,
+	}
+	for fname, contents := range want {
+		got, err := os.ReadFile(filepath.Join("site", fname))
+		assert.NoErrorf(err, "reading %q", fname)
+		assert.Equal(contents, string(got))
+	}
+	assert.Equal(int32(len(want)), gets.Load())
+
+	// a second pull finds everything unchanged
+	err = pull.pull(ctx, cfg)
+	require.NoError(err)
+	assert.Equal(int32(len(want)), gets.Load())
+
+	_, err = localPathFor("site", "../escape.txt")
+	assert.Error(err)
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultMaxRetries   = 5
+	defaultRetryMinWait = 500 * time.Millisecond
+	defaultRetryMaxWait = 30 * time.Second
+	retryAfterHeader    = "Retry-After"
+
+	// defaultBusyRetries and defaultBusyWait are for 429 Too Many Requests
+	// without a Retry-After. The server sends it while it moves an efmrl to
+	// dedicated storage, which takes longer than the backoff above lasts.
+	defaultBusyRetries = 12
+	defaultBusyWait    = 5 * time.Second
+)
+
+// retryConfig is the "retry" section of the config. Zero values mean the
+// defaults; a negative MaxRetries means never retry.
+type retryConfig struct {
+	MaxRetries int      `json:"max_retries,omitempty"`
+	MinWait    duration `json:"min_wait,omitempty"`
+	MaxWait    duration `json:"max_wait,omitempty"`
+}
+
+// retryFlags holds the global --retries and --retry-max-wait flags, which
+// override the config. main sets it, much as it sets slog's default logger.
+var retryFlags retryConfig
+
+// duration is a time.Duration written as in Go, e.g. "500ms" or "1m30s", in
+// the config file
+type duration time.Duration
+
+func (d *duration) UnmarshalText(text []byte) error {
+	val, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = duration(val)
+
+	return nil
+}
+
+func (d duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+// retryPolicy decides whether and when to retry a request. 429s are
+// counted apart from other failures.
+type retryPolicy struct {
+	maxRetries  int
+	minWait     time.Duration
+	maxWait     time.Duration
+	busyRetries int
+	busyWait    time.Duration
+}
+
+// retryPolicy returns the policy from the defaults, then the config, then
+// the flags
+func (cfg *Config) retryPolicy() *retryPolicy {
+	rp := &retryPolicy{
+		maxRetries:  defaultMaxRetries,
+		minWait:     defaultRetryMinWait,
+		maxWait:     defaultRetryMaxWait,
+		busyRetries: defaultBusyRetries,
+		busyWait:    defaultBusyWait,
+	}
+	for _, rc := range []*retryConfig{cfg.Retry, &retryFlags} {
+		if rc == nil {
+			continue
+		}
+		if rc.MaxRetries != 0 {
+			rp.maxRetries = max(rc.MaxRetries, 0)
+		}
+		if rc.MinWait > 0 {
+			rp.minWait = time.Duration(rc.MinWait)
+		}
+		if rc.MaxWait > 0 {
+			rp.maxWait = time.Duration(rc.MaxWait)
+		}
+	}
+	rp.minWait = min(rp.minWait, rp.maxWait)
+	if rp.maxRetries == 0 {
+		rp.busyRetries = 0
+	}
+
+	return rp
+}
+
+// retryable reports whether a request with this result is worth trying
+// again. Only idempotent requests are retried: those with idempotent
+// methods, and others marked with an Idempotency-Key header, as net/http
+// does.
+func retryable(req *http.Request, res *http.Response, err error) bool {
+	if req.Context().Err() != nil {
+		return false
+	}
+	if !idempotent(req) {
+		return false
+	}
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		return false
+	}
+	if err != nil {
+		return !errors.Is(err, context.Canceled) &&
+			!errors.Is(err, context.DeadlineExceeded)
+	}
+
+	return res.StatusCode == http.StatusTooManyRequests ||
+		res.StatusCode >= 500 && res.StatusCode != http.StatusNotImplemented
+}
+
+func idempotent(req *http.Request) bool {
+	switch req.Method {
+	case "GET", "HEAD", "OPTIONS", "PUT", "DELETE":
+		return true
+	}
+	_, ok := req.Header["Idempotency-Key"]
+	return ok
+}
+
+// wait returns how long to wait before the given retry, counting from 1.
+// The wait doubles each time, from minWait up to maxWait, and is spread
+// randomly over its upper half so that clients don't retry in step. A
+// Retry-After from the server is honored, up to maxWait; a 429 without one
+// waits busyWait.
+func (rp *retryPolicy) wait(retry int, res *http.Response) time.Duration {
+	if res != nil {
+		if after, ok := retryAfter(res.Header.Get(retryAfterHeader)); ok {
+			return min(after, rp.maxWait)
+		}
+		if res.StatusCode == http.StatusTooManyRequests {
+			return rp.busyWait
+		}
+	}
+
+	wait := rp.minWait
+	for i := 1; i < retry && wait < rp.maxWait; i++ {
+		wait *= 2
+	}
+	wait = min(wait, rp.maxWait)
+	half := wait / 2
+
+	return half + rand.N(wait-half+1)
+}
+
+// retryAfter parses a Retry-After header, which is either seconds or an
+// HTTP date
+func retryAfter(value string) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(value); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second, true
+	}
+	if when, err := http.ParseTime(value); err == nil {
+		return max(time.Until(when), 0), true
+	}
+
+	return 0, false
+}
+
+// retryTransport retries idempotent requests that fail with 429, a 5xx or
+// a network error, up to busyRetries times for 429s and maxRetries for the
+// rest
+type retryTransport struct {
+	next   http.RoundTripper
+	policy *retryPolicy
+}
+
+func (rt *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	retries, busy := 0, 0
+	for {
+		res, err := rt.next.RoundTrip(req)
+		if !retryable(req, res, err) {
+			return res, err
+		}
+		retry, limit := 0, 0
+		if err == nil && res.StatusCode == http.StatusTooManyRequests {
+			busy++
+			retry, limit = busy, rt.policy.busyRetries
+		} else {
+			retries++
+			retry, limit = retries, rt.policy.maxRetries
+		}
+		if retry > limit {
+			return res, err
+		}
+
+		wait := rt.policy.wait(retry, res)
+		attrs := []any{
+			"method", req.Method,
+			"url", req.URL.String(),
+			"retry", retry,
+			"wait", wait,
+		}
+		if err != nil {
+			attrs = append(attrs, "error", err)
+		} else {
+			attrs = append(attrs, "status", res.StatusCode)
+			io.Copy(io.Discard, res.Body)
+			res.Body.Close()
+		}
+		slog.Info("retrying", attrs...)
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+	}
+}
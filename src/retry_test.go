@@ -0,0 +1,218 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetry(t *testing.T) {
+	var (
+		calls    atomic.Int32
+		failures atomic.Int32
+		status   = http.StatusServiceUnavailable
+		after    string
+		bodies   []string
+	)
+	f := func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		body, _ := io.ReadAll(r.Body)
+		bodies = append(bodies, string(body))
+		if failures.Add(-1) >= 0 {
+			if after != "" {
+				w.Header().Set(retryAfterHeader, after)
+			}
+			w.WriteHeader(status)
+			return
+		}
+	}
+	ts := httptest.NewServer(http.HandlerFunc(f))
+	defer ts.Close()
+
+	policy := &retryPolicy{
+		maxRetries:  3,
+		minWait:     time.Millisecond,
+		maxWait:     10 * time.Millisecond,
+		busyRetries: 6,
+		busyWait:    time.Millisecond,
+	}
+	client := &http.Client{
+		Transport: &retryTransport{next: http.DefaultTransport, policy: policy},
+	}
+	reset := func(fails int) {
+		calls.Store(0)
+		failures.Store(int32(fails))
+		bodies = nil
+	}
+
+	t.Run("idempotent requests are retried", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		reset(2)
+		req, err := http.NewRequest("PUT", ts.URL, strings.NewReader("data"))
+		require.NoError(err)
+		res, err := client.Do(req)
+		require.NoError(err)
+		res.Body.Close()
+		assert.Equal(http.StatusOK, res.StatusCode)
+		assert.Equal(int32(3), calls.Load())
+		assert.Equal([]string{"data", "data", "data"}, bodies)
+	})
+
+	t.Run("retries run out", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		reset(10)
+		res, err := client.Get(ts.URL)
+		require.NoError(err)
+		res.Body.Close()
+		assert.Equal(http.StatusServiceUnavailable, res.StatusCode)
+		assert.Equal(int32(4), calls.Load())
+	})
+
+	t.Run("POST only if marked", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		reset(1)
+		res, err := client.Post(ts.URL, "application/json", strings.NewReader("{}"))
+		require.NoError(err)
+		res.Body.Close()
+		assert.Equal(http.StatusServiceUnavailable, res.StatusCode)
+		assert.Equal(int32(1), calls.Load())
+
+		reset(1)
+		req, err := http.NewRequest("POST", ts.URL, strings.NewReader("{}"))
+		require.NoError(err)
+		req.Header["Idempotency-Key"] = nil
+		res, err = client.Do(req)
+		require.NoError(err)
+		res.Body.Close()
+		assert.Equal(http.StatusOK, res.StatusCode)
+		assert.Equal(int32(2), calls.Load())
+	})
+
+	t.Run("4xx is not retried", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		defer func() { status = http.StatusServiceUnavailable }()
+		status = http.StatusNotFound
+		reset(1)
+		res, err := client.Get(ts.URL)
+		require.NoError(err)
+		res.Body.Close()
+		assert.Equal(http.StatusNotFound, res.StatusCode)
+		assert.Equal(int32(1), calls.Load())
+	})
+
+	t.Run("429 honors Retry-After", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		defer func() { status, after = http.StatusServiceUnavailable, "" }()
+		status, after = http.StatusTooManyRequests, "0"
+		reset(1)
+		res, err := client.Get(ts.URL)
+		require.NoError(err)
+		res.Body.Close()
+		assert.Equal(http.StatusOK, res.StatusCode)
+		assert.Equal(int32(2), calls.Load())
+	})
+
+	t.Run("429 has a budget of its own", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		defer func() { status = http.StatusServiceUnavailable }()
+		status = http.StatusTooManyRequests
+		reset(5)
+		res, err := client.Get(ts.URL)
+		require.NoError(err)
+		res.Body.Close()
+		assert.Equal(http.StatusOK, res.StatusCode)
+		assert.Equal(int32(6), calls.Load())
+
+		reset(10)
+		res, err = client.Get(ts.URL)
+		require.NoError(err)
+		res.Body.Close()
+		assert.Equal(http.StatusTooManyRequests, res.StatusCode)
+		assert.Equal(int32(7), calls.Load())
+	})
+
+	t.Run("wait", func(t *testing.T) {
+		assert := assert.New(t)
+
+		rp := &retryPolicy{
+			maxRetries: 10,
+			minWait:    100 * time.Millisecond,
+			maxWait:    time.Second,
+			busyWait:   5 * time.Second,
+		}
+		for retry, top := range map[int]time.Duration{
+			1:  100 * time.Millisecond,
+			2:  200 * time.Millisecond,
+			4:  800 * time.Millisecond,
+			5:  time.Second,
+			99: time.Second,
+		} {
+			wait := rp.wait(retry, nil)
+			assert.LessOrEqual(wait, top, retry)
+			assert.GreaterOrEqual(wait, top/2, retry)
+		}
+
+		res := &http.Response{Header: http.Header{}}
+		res.Header.Set(retryAfterHeader, "0")
+		assert.Equal(time.Duration(0), rp.wait(3, res))
+		res.Header.Set(retryAfterHeader, "3600")
+		assert.Equal(time.Second, rp.wait(1, res))
+		date := time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)
+		res.Header.Set(retryAfterHeader, date)
+		assert.Equal(time.Second, rp.wait(1, res))
+		res.Header.Set(retryAfterHeader, "soon")
+		assert.LessOrEqual(rp.wait(1, res), 100*time.Millisecond)
+		res.StatusCode = http.StatusTooManyRequests
+		assert.Equal(5*time.Second, rp.wait(1, res))
+	})
+
+	t.Run("policy from config and flags", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		defer func() { retryFlags = retryConfig{} }()
+
+		cfg := &Config{}
+		assert.Equal(&retryPolicy{
+			maxRetries:  defaultMaxRetries,
+			minWait:     defaultRetryMinWait,
+			maxWait:     defaultRetryMaxWait,
+			busyRetries: defaultBusyRetries,
+			busyWait:    defaultBusyWait,
+		}, cfg.retryPolicy())
+
+		rc := &retryConfig{}
+		require.NoError(rc.MinWait.UnmarshalText([]byte("2s")))
+		rc.MaxRetries = -1
+		cfg.Retry = rc
+		rp := cfg.retryPolicy()
+		assert.Equal(0, rp.maxRetries)
+		assert.Equal(0, rp.busyRetries)
+		assert.Equal(2*time.Second, rp.minWait)
+
+		retryFlags = retryConfig{MaxRetries: 7, MaxWait: duration(time.Second)}
+		rp = cfg.retryPolicy()
+		assert.Equal(7, rp.maxRetries)
+		assert.Equal(time.Second, rp.minWait)
+		assert.Equal(time.Second, rp.maxWait)
+	})
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/efmrl/api2"
+)
+
+const (
+	// reloadPath is where pages listen for changes. It is under the API
+	// prefix, so it can't hide a file.
+	reloadPath = api2.DefaultAPIPrefix + "/serve/reload"
+	// reloadWait is how long changes are let settle before pages reload
+	reloadWait = 100 * time.Millisecond
+)
+
+// reloadScript is put at the end of HTML pages, to reload them when files
+// change
+const reloadScript = `<script>new EventSource("` + reloadPath + `").onmessage = () => location.reload();</script>`
+
+// ServeCmd serves RootDir and the mounts locally, the way the efmrl would,
+// except that files are served as they are, uncompressed, even if the
+// config has sync compress them
+type ServeCmd struct {
+	Addr     string        `short:"a" default:"localhost:8080" help:"address to listen on"`
+	NoReload bool          `help:"don't reload pages in the browser when files change"`
+	Poll     time.Duration `help:"look for changes this often instead of relying on file system events, e.g. 2s for network file systems and container mounts"`
+}
+
+// Run the "serve" subcommand
+func (sc *ServeCmd) Run(ctx *CLIContext) error {
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	cfg.skipLen = len(cfg.RootDir) + 1 // +1 for '/' separator
+
+	tw, err := newTreeWatcher(ctx, cfg, sc.Poll)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err := tw.close()
+		if err != nil {
+			ctx.logger().Warn("cannot close watcher", "error", err)
+		}
+	}()
+	ps := newPreviewServer(ctx, cfg, !sc.NoReload)
+	go func() {
+		for range tw.changes {
+			ps.changed()
+		}
+	}()
+
+	ln, err := net.Listen("tcp", sc.Addr)
+	if err != nil {
+		return err
+	}
+	srv := &http.Server{Handler: ps}
+	stop := ctx.stopContext()
+	go func() {
+		<-stop.Done()
+		// pages waiting to reload are let go by stop, too
+		_ = srv.Shutdown(context.Background())
+	}()
+
+	fmt.Fprintf(ctx.chatter(), "serving %v at http://%v/\n", cfg.RootDir, ln.Addr())
+	err = srv.Serve(ln)
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+
+	return err
+}
+
+// previewServer serves the files under RootDir and the mounts at the paths
+// that sync pushes them to, with the same content types and headers
+type previewServer struct {
+	cli    *CLIContext
+	cfg    *Config
+	reload bool
+
+	mu      sync.Mutex
+	items   map[string]*servedFile // by seenKey; nil when files changed
+	pages   map[chan struct{}]bool
+	settled *time.Timer // reloads pages when changes settle
+}
+
+func newPreviewServer(ctx *CLIContext, cfg *Config, reload bool) *previewServer {
+	ps := &previewServer{
+		cli:    ctx,
+		cfg:    cfg,
+		reload: reload,
+		pages:  map[chan struct{}]bool{},
+	}
+	ps.settled = time.AfterFunc(time.Hour, ps.reloadPages)
+	ps.settled.Stop()
+
+	return ps
+}
+
+// changed notes that files under RootDir or a mount changed
+func (ps *previewServer) changed() {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.items = nil
+	ps.settled.Reset(reloadWait)
+}
+
+// reloadPages tells every page that is listening to reload
+func (ps *previewServer) reloadPages() {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	for page := range ps.pages {
+		select {
+		case page <- struct{}{}:
+		default:
+			// it has a reload waiting already
+		}
+	}
+}
+
+// servedFile is a local file, and the mount it is in
+type servedFile struct {
+	item *workItem
+	cfg  *Config
+}
+
+// lookup returns the file that is served at key, walking RootDir and the
+// mounts again if files changed
+func (ps *previewServer) lookup(key string) (*servedFile, error) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	if ps.items == nil {
+		items := map[string]*servedFile{}
+		for _, cfg := range ps.cfg.mounts() {
+			err := walkLocal(cfg, func(string) {}, func(item *workItem) error {
+				items[item.seenKey(cfg)] = &servedFile{item: item, cfg: cfg}
+				return nil
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+		ps.items = items
+	}
+
+	return ps.items[key], nil
+}
+
+func (ps *previewServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if r.URL.Path == reloadPath && ps.reload {
+		ps.serveReload(w, r)
+		return
+	}
+
+	key := strings.TrimPrefix(r.URL.Path, "/")
+	if key == "" {
+		key = "/"
+	}
+	file, err := ps.lookup(key)
+	if err == nil && file == nil && strings.HasSuffix(key, "/") && key != "/" {
+		file, err = ps.lookup(strings.TrimSuffix(key, "/"))
+	}
+	if err != nil {
+		ps.cli.logger().Error("cannot walk the root directory", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if file == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	item := file.item
+	contentType, err := item.getContentType(file.cfg)
+	if err == nil {
+		var headers http.Header
+		headers, err = item.getHeaders(file.cfg)
+		for name, values := range headers {
+			w.Header()[name] = values
+		}
+	}
+	var f *os.File
+	if err == nil {
+		f, err = os.Open(item.path)
+	}
+	if err != nil {
+		ps.cli.logger().Error("cannot serve file", "path", item.path, "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	w.Header().Set(contentTypeHeader, contentType)
+
+	ps.cli.logger().Debug("serving", "path", r.URL.Path, "file", item.path)
+	if !ps.reload || !strings.HasPrefix(contentType, "text/html") {
+		http.ServeContent(w, r, "", item.info.ModTime(), f)
+		return
+	}
+
+	// only pages are read in, to add the reload script
+	page, err := io.ReadAll(f)
+	if err != nil {
+		ps.cli.logger().Error("cannot serve file", "path", item.path, "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.ServeContent(w, r, "", item.info.ModTime(), bytes.NewReader(injectReload(page)))
+}
+
+// serveReload sends an event to the page whenever it should reload, until
+// the page goes away or the user asks to stop
+func (ps *previewServer) serveReload(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	page := make(chan struct{}, 1)
+	ps.mu.Lock()
+	ps.pages[page] = true
+	ps.mu.Unlock()
+	defer func() {
+		ps.mu.Lock()
+		defer ps.mu.Unlock()
+		delete(ps.pages, page)
+	}()
+
+	w.Header().Set(contentTypeHeader, "text/event-stream")
+	w.Header().Set(cacheControlHeader, "no-store")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	stop := ps.cli.stopContext()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-stop.Done():
+			return
+		case <-page:
+			if _, err := io.WriteString(w, "data: reload\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// injectReload puts the reload script before the end of the body, or at
+// the end of the page if there's no </body>
+func injectReload(page []byte) []byte {
+	i := bytes.LastIndex(bytes.ToLower(page), []byte("</body>"))
+	if i < 0 {
+		return append(page, reloadScript...)
+	}
+
+	out := make([]byte, 0, len(page)+len(reloadScript))
+	out = append(out, page[:i]...)
+	out = append(out, reloadScript...)
+	return append(out, page[i:]...)
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServe(t *testing.T) {
+	goBack, err := cdTmp(t)
+	require.NoError(t, err)
+	defer goBack()
+
+	writeTree(t, "site", map[string]string{
+		"index.html":       "<h1>home</h1></body>",
+		"about/index.html": "<h1>about</h1>",
+		"css/site.css":     "body {}",
+		"notes":            "no extension",
+		"skip/me.txt":      "ignored",
+		ignoreFileName:     "skip/\n",
+	})
+	writeTree(t, "static", map[string]string{
+		"logo.svg":   "<svg/>",
+		"index.html": "<h1>assets</h1>",
+	})
+	cfg := &Config{
+		RootDir:      "site",
+		Mounts:       []*mountConfig{{Local: "static", RemotePrefix: "/assets"}},
+		indexRewrite: map[string]bool{"index.html": true},
+		Headers: []*headerRule{
+			{Match: "css/", Headers: map[string]string{
+				"Cache-Control": "max-age=60",
+			}},
+			{Match: "assets/", Headers: map[string]string{
+				"Cache-Control": "max-age=3600",
+			}},
+		},
+		skipLen: len("site") + 1,
+	}
+	require.NoError(t, cfg.compileHeaderRules())
+
+	ps := newPreviewServer(&CLIContext{Quiet: true}, cfg, true)
+	ts := httptest.NewServer(ps)
+	defer ts.Close()
+
+	get := func(path string) (*http.Response, string) {
+		res, err := http.Get(ts.URL + path)
+		require.NoError(t, err)
+		defer res.Body.Close()
+		body, err := io.ReadAll(res.Body)
+		require.NoError(t, err)
+		return res, string(body)
+	}
+
+	t.Run("paths, types and headers", func(t *testing.T) {
+		assert := assert.New(t)
+
+		res, body := get("/")
+		assert.Equal(http.StatusOK, res.StatusCode)
+		assert.Equal("text/html; charset=utf-8", res.Header.Get("Content-Type"))
+		assert.Equal("<h1>home</h1>"+reloadScript+"</body>", body)
+
+		for _, path := range []string{"/about", "/about/"} {
+			res, body = get(path)
+			assert.Equal(http.StatusOK, res.StatusCode, path)
+			assert.Equal("<h1>about</h1>"+reloadScript, body, path)
+		}
+
+		res, body = get("/css/site.css")
+		assert.Equal("body {}", body)
+		assert.Equal("text/css; charset=utf-8", res.Header.Get("Content-Type"))
+		assert.Equal("max-age=60", res.Header.Get("Cache-Control"))
+
+		// mounts are served at their prefix, with header rules that match it
+		res, body = get("/assets/logo.svg")
+		assert.Equal("<svg/>", body)
+		assert.Equal("max-age=3600", res.Header.Get("Cache-Control"))
+		_, body = get("/assets")
+		assert.Equal("<h1>assets</h1>"+reloadScript, body)
+
+		req, err := http.NewRequest("GET", ts.URL+"/css/site.css", nil)
+		require.NoError(t, err)
+		req.Header.Set("Range", "bytes=0-3")
+		res, err = http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		part, err := io.ReadAll(res.Body)
+		res.Body.Close()
+		require.NoError(t, err)
+		assert.Equal(http.StatusPartialContent, res.StatusCode)
+		assert.Equal("body", string(part))
+
+		res, _ = get("/notes")
+		assert.Equal(defaultCache, res.Header.Get("Cache-Control"))
+		assert.Equal("text/plain; charset=utf-8", res.Header.Get("Content-Type"))
+
+		// index files are only at their directory, as sync pushes them
+		for _, path := range []string{"/index.html", "/about/index.html", "/skip/me.txt", "/nope"} {
+			res, _ = get(path)
+			assert.Equal(http.StatusNotFound, res.StatusCode, path)
+		}
+
+		res, err = http.Post(ts.URL+"/", "text/plain", strings.NewReader("x"))
+		require.NoError(t, err)
+		res.Body.Close()
+		assert.Equal(http.StatusMethodNotAllowed, res.StatusCode)
+	})
+
+	t.Run("changes reload pages", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		res, err := http.Get(ts.URL + reloadPath)
+		require.NoError(err)
+		defer res.Body.Close()
+		assert.Equal("text/event-stream", res.Header.Get("Content-Type"))
+
+		writeTree(t, "site", map[string]string{"new.txt": "new"})
+		ps.changed()
+		lines := bufio.NewReader(res.Body)
+		line, err := lines.ReadString('\n')
+		require.NoError(err)
+		assert.Equal("data: reload\n", line)
+
+		_, body := get("/new.txt")
+		assert.Equal("new", body)
+	})
+
+	t.Run("inject", func(t *testing.T) {
+		assert := assert.New(t)
+
+		assert.Equal("<p>a</p>"+reloadScript+"</BODY></html>", string(injectReload([]byte("<p>a</p></BODY></html>"))))
+		assert.Equal("<p>a</p>"+reloadScript, string(injectReload([]byte("<p>a</p>"))))
+	})
+
+}
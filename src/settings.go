@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"net/http/httptest"
 	"os"
@@ -32,7 +33,10 @@ type InitCmd struct {
 }
 
 // updateConfig updates a config struct with all nonzero members of common
-func (common *CommonSet) updateConfig(cfg *Config) error {
+func (common *CommonSet) updateConfig(
+	ctx context.Context,
+	cfg *Config,
+) error {
 	for _, fname := range common.NoRewrite {
 		delete(cfg.indexRewrite, fname)
 		cfg.indexNoRewrite[fname] = true
@@ -51,7 +55,7 @@ func (common *CommonSet) updateConfig(cfg *Config) error {
 	}
 
 	if cfg.CanonURL == "" {
-		err := cfg.getCanonURL()
+		err := cfg.getCanonURL(ctx)
 		if err != nil {
 			return err
 		}
@@ -61,7 +65,7 @@ func (common *CommonSet) updateConfig(cfg *Config) error {
 }
 
 // updateConfig updates a config struct with all nonzero members of set
-func (set *SetCmd) updateConfig(cfg *Config) error {
+func (set *SetCmd) updateConfig(ctx context.Context, cfg *Config) error {
 	if set.Efmrl != "" {
 		cfg.Efmrl = set.Efmrl
 	}
@@ -70,7 +74,7 @@ func (set *SetCmd) updateConfig(cfg *Config) error {
 		cfg.RootDir = set.RootDir
 	}
 
-	err := set.CommonSet.updateConfig(cfg)
+	err := set.CommonSet.updateConfig(ctx, cfg)
 	if err != nil {
 		return err
 	}
@@ -90,7 +94,7 @@ func (set *SetCmd) Run(ctx *CLIContext) error {
 		return err
 	}
 
-	err = set.updateConfig(cfg)
+	err = set.updateConfig(ctx.stopContext(), cfg)
 	if err != nil {
 		return err
 	}
@@ -101,7 +105,7 @@ func (set *SetCmd) Run(ctx *CLIContext) error {
 	}
 
 	if !ctx.Quiet {
-		fmt.Printf("%q updated\n", configName)
+		fmt.Fprintf(ctx.chatter(), "%q updated\n", configName)
 	}
 
 	return nil
@@ -123,7 +127,7 @@ func (init *InitCmd) Run(ctx *CLIContext) error {
 		BaseHost: init.BaseHost,
 		ts:       init.ts,
 	}
-	err := init.updateConfig(cfg)
+	err := init.updateConfig(ctx.stopContext(), cfg)
 	if err != nil {
 		return err
 	}
@@ -134,7 +138,7 @@ func (init *InitCmd) Run(ctx *CLIContext) error {
 	}
 
 	if !ctx.Quiet {
-		fmt.Printf("%q created\n", configName)
+		fmt.Fprintf(ctx.chatter(), "%q created\n", configName)
 	}
 
 	return nil
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"fmt"
+	"net/http/httptest"
+)
+
+// StatusCmd shows what "sync" would do, without uploading
+type StatusCmd struct {
+	All            bool `short:"a" help:"list unchanged files too"`
+	CrossFS        bool `short:"X" help:"cross filesystem mounts within the efmrl"`
+	Rehash         bool `help:"ignore the local hash cache and re-read every file"`
+	NoCheckHeaders bool `help:"don't compare the headers of unchanged files with the header rules, which takes a HEAD request per file"`
+	MaxFiles       int  `hidden:""`
+
+	ts *httptest.Server
+}
+
+// statusReport groups local and remote files by how they compare. Paths are
+// relative to RootDir, under the prefix for files in a mount, or to the
+// efmrl for remote files.
+type statusReport struct {
+	New               []string `json:"new"`
+	Modified          []string `json:"modified"`
+	Unchanged         []string `json:"unchanged"`
+	HeadersDiffer     []string `json:"headers_differ"`
+	RemoteOnly        []string `json:"remote_only"`
+	RewriteCandidates []string `json:"rewrite_candidates"`
+	// HeadersUnchecked is set if there are header rules, but headers
+	// weren't compared with them
+	HeadersUnchecked bool `json:"headers_unchecked,omitempty"`
+}
+
+// differs returns how many files a sync with --delete-others would touch
+func (sr *statusReport) differs() int {
+	return len(sr.New) + len(sr.Modified) + len(sr.HeadersDiffer) +
+		len(sr.RemoteOnly)
+}
+
+// Run the "status" subcommand
+func (st *StatusCmd) Run(ctx *CLIContext) error {
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	cfg.ts = st.ts
+	msg, err := loggedIn(ctx.stopContext(), cfg)
+	if err != nil {
+		return err
+	}
+	if msg != "" {
+		fmt.Fprintln(ctx.chatter(), msg)
+		return nil
+	}
+
+	report, err := st.status(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	err = st.print(ctx, report)
+	if err != nil {
+		return err
+	}
+
+	if n := report.differs(); n > 0 {
+		return &exitError{
+			code: exitDiffers,
+			err:  fmt.Errorf("%v files differ from efmrl", n),
+		}
+	}
+
+	return nil
+}
+
+func (st *StatusCmd) status(
+	ctx *CLIContext,
+	cfg *Config,
+) (*statusReport, error) {
+	cfg.skipLen = len(cfg.RootDir) + 1 // +1 for '/' separator
+
+	seen := seenMap{}
+	err := setSeenMap(cfg, ctx, seen, st.MaxFiles, st.CrossFS)
+	if err != nil {
+		return nil, err
+	}
+
+	// a sync that never uploads, to compare files the same way sync does
+	sync := &SyncCmd{
+		quiet: true,
+		cli:   ctx,
+	}
+	sync.hashes, err = loadHashCache(cfg, st.Rehash)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Compress != nil {
+		sync.compress, err = newCompressor(cfg, sync.hashes)
+		if err != nil {
+			return nil, err
+		}
+	}
+	client, err := cfg.getClient()
+	if err != nil {
+		return nil, err
+	}
+	checkHeaders := !st.NoCheckHeaders && len(cfg.Headers) > 0
+
+	// empty rather than nil, so that JSON has lists to iterate
+	report := &statusReport{
+		New:               []string{},
+		Modified:          []string{},
+		Unchanged:         []string{},
+		HeadersDiffer:     []string{},
+		RemoteOnly:        []string{},
+		RewriteCandidates: []string{},
+		HeadersUnchecked:  st.NoCheckHeaders && len(cfg.Headers) > 0,
+	}
+	for _, mcfg := range cfg.mounts() {
+		err = walkLocal(
+			mcfg,
+			func(string) {},
+			func(item *workItem) error {
+				rel := item.rel(mcfg)
+				if _, warn := mcfg.needsRewrite(item.path); warn != "" {
+					report.RewriteCandidates = append(report.RewriteCandidates, rel)
+				}
+
+				contentType, err := item.getContentType(mcfg)
+				if err != nil {
+					return err
+				}
+				headers, err := item.getHeaders(mcfg)
+				if err != nil {
+					return err
+				}
+				err = sync.compress.compress(mcfg, item, contentType, headers)
+				if err != nil {
+					return err
+				}
+
+				isNew := seen[item.seenKey(mcfg)] == nil
+				same, err := sync.unchanged(mcfg, item, seen)
+				if err != nil {
+					return err
+				}
+				if same && checkHeaders {
+					url := mcfg.pathToURL(mcfg.prefix, item.pushPath(mcfg)).String()
+					differ, err := headersDiffer(ctx.stopContext(), client, url, headers)
+					if err != nil {
+						return err
+					}
+					if differ {
+						report.HeadersDiffer = append(report.HeadersDiffer, rel)
+						return nil
+					}
+				}
+
+				switch {
+				case isNew:
+					report.New = append(report.New, rel)
+				case same:
+					report.Unchanged = append(report.Unchanged, rel)
+				default:
+					report.Modified = append(report.Modified, rel)
+				}
+				return nil
+			},
+		)
+		if err != nil {
+			break
+		}
+	}
+	if saveErr := sync.hashes.save(); saveErr != nil && err == nil {
+		err = saveErr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	stale, err := staleFiles(cfg, seen)
+	if err != nil {
+		return nil, err
+	}
+	report.RemoteOnly = append(report.RemoteOnly, stale...)
+
+	return report, nil
+}
+
+func (st *StatusCmd) print(ctx *CLIContext, report *statusReport) error {
+	switch ctx.Output {
+	case outputJSON:
+		return ctx.writeJSON(report)
+	case outputPlain:
+		tbl := &table{}
+		addGroup := func(state string, paths []string) {
+			for _, path := range paths {
+				tbl.add(state, path)
+			}
+		}
+		addGroup("new", report.New)
+		addGroup("modified", report.Modified)
+		addGroup("headers", report.HeadersDiffer)
+		addGroup("remote-only", report.RemoteOnly)
+		addGroup("rewrite", report.RewriteCandidates)
+		if st.All {
+			addGroup("unchanged", report.Unchanged)
+		}
+		return ctx.showList(report, tbl)
+	}
+
+	out := ctx.stdout()
+	showGroup := func(title string, paths []string) {
+		if len(paths) == 0 {
+			return
+		}
+		fmt.Fprintf(out, "%v (%v):\n", title, len(paths))
+		for _, path := range paths {
+			fmt.Fprintf(out, "    %v\n", path)
+		}
+	}
+
+	showGroup("new", report.New)
+	showGroup("modified", report.Modified)
+	showGroup("headers differ, re-pushed by sync", report.HeadersDiffer)
+	showGroup("remote only, deleted by sync -D", report.RemoteOnly)
+	showGroup(`rewrite candidates, see "efmrl set --help"`, report.RewriteCandidates)
+	if st.All {
+		showGroup("unchanged", report.Unchanged)
+	} else if len(report.Unchanged) > 0 {
+		fmt.Fprintf(out, "unchanged: %v files\n", len(report.Unchanged))
+	}
+	if report.HeadersUnchecked {
+		fmt.Fprintln(out, "headers were not checked against the header rules")
+	}
+
+	if report.differs() == 0 {
+		fmt.Fprintln(out, "efmrl is up to date")
+	}
+
+	return nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/efmrl/api2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// listFilesServer answers file listings with files, a map from path to
+// contents.
+func listFilesServer(files map[string]string) *httptest.Server {
+	f := func(w http.ResponseWriter, r *http.Request) {
+		res := &api2.ListFilesRes{
+			Files: map[string]*api2.FileInfo{},
+		}
+		for fname, contents := range files {
+			sum := md5.Sum([]byte(contents))
+			res.Files["/"+fname] = &api2.FileInfo{
+				ETAG:  `"` + hex.EncodeToString(sum[:]) + `"`,
+				Bytes: len(contents),
+			}
+		}
+		err := json.NewEncoder(w).Encode(api2.NewSuccessAny(res))
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	return httptest.NewTLSServer(http.HandlerFunc(f))
+}
+
+// writeTree creates files, a map from path to contents, under root
+func writeTree(t *testing.T, root string, files map[string]string) {
+	for fname, contents := range files {
+		fpath := filepath.Join(root, fname)
+		require.NoError(t, os.MkdirAll(filepath.Dir(fpath), 0777))
+		require.NoError(t, os.WriteFile(fpath, []byte(contents), 0666))
+	}
+}
+
+func TestStatus(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	goBack, err := cdTmp(t)
+	require.NoError(err)
+	defer goBack()
+	cleanup, err := fakeHome(t)
+	require.NoError(err)
+	defer cleanup()
+
+	writeTree(t, "site", map[string]string{
+		"same.html":        "same",
+		"changed.html":     "new contents",
+		"added.html":       "brand new",
+		"blog/index.htm":   "maybe a dir",
+		"drafts/wip.html":  "ignored",
+		ignoreFileName:     "drafts/\n*.map\n",
+		"docs/index.html":  "docs",
+		"docs/ignored.map": "ignored",
+	})
+	ts := listFilesServer(map[string]string{
+		"same.html":    "same",
+		"changed.html": "old contents",
+		"docs":         "docs",
+		"stale.html":   "gone locally",
+		"app.js.map":   "ignored remotely",
+	})
+	defer ts.Close()
+
+	cfg := &Config{
+		Efmrl:        "status-quo",
+		CanonURL:     ts.URL,
+		RootDir:      "site",
+		indexRewrite: map[string]bool{"index.html": true},
+		ts:           ts,
+	}
+	require.NoError(cfg.prep())
+
+	st := &StatusCmd{}
+	report, err := st.status(&CLIContext{Quiet: true}, cfg)
+	require.NoError(err)
+
+	assert.Equal([]string{"added.html", "blog/index.htm"}, report.New)
+	assert.Equal([]string{"changed.html"}, report.Modified)
+	assert.Equal([]string{"docs/index.html", "same.html"}, report.Unchanged)
+	assert.Equal([]string{"stale.html"}, report.RemoteOnly)
+	assert.Equal([]string{"blog/index.htm"}, report.RewriteCandidates)
+	assert.Equal(4, report.differs())
+}
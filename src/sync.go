@@ -4,19 +4,20 @@ import (
 	"context"
 	"fmt"
 	"io"
-	"io/fs"
-	"log"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path"
 	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/efmrl/api2"
-	"github.com/fsnotify/fsnotify"
 
+	"efmrl.com/efmrl/cli/efmrlclient"
 	"golang.org/x/sync/errgroup"
 )
 
@@ -24,25 +25,45 @@ const (
 	contentTypeHeader  = "Content-Type"
 	cacheControlHeader = "Cache-Control"
 	defaultCache       = "no-cache"
-	defaultMaxRetries  = 12
 )
 
 // SyncCmd holds common parts between "sync" and "version"
 type SyncCmd struct {
-	Watch        bool          `short:"w" help:"watch for changes and auto-run"`
-	DryRun       bool          `short:"n" help:"show files that would be pushed without pushing them"`
-	Force        bool          `short:"f" help:"force sync; don't skip even if file is unchanged"`
-	DeleteOthers bool          `short:"D" help:"delete files on server that are not in local directory"`
-	CrossFS      bool          `short:"X" help:"cross filesystem mounts within the efmrl"`
-	Debug        bool          `help:"add debugging output"`
-	Parallel     int           `default:"1" short:"p" help:"how many files to upload at once"`
-	WatchWait    time.Duration `default:"1s" help:"duration to wait for changes to finish before syncing"`
-	MaxFiles     int           `hidden:""`
+	Watch          bool          `short:"w" help:"watch for changes and auto-run"`
+	DryRun         bool          `short:"n" help:"show files that would be pushed without pushing them"`
+	Force          bool          `short:"f" help:"force sync; don't skip even if file is unchanged"`
+	Rehash         bool          `help:"ignore the local hash cache and re-read every file"`
+	DeleteOthers   bool          `short:"D" help:"delete files on server that are not in local directory"`
+	CrossFS        bool          `short:"X" help:"cross filesystem mounts within the efmrl"`
+	Atomic         bool          `help:"push HTML only after all other files, and delete only after all pushes succeed"`
+	NoCheckHeaders bool          `help:"don't re-push unchanged files whose headers differ from the header rules; checking takes a HEAD request per file"`
+	Parallel       int           `default:"1" short:"p" help:"how many files to upload or delete at once"`
+	WatchWait      time.Duration `default:"1s" help:"duration to wait for changes to finish before syncing"`
+	Reconcile      time.Duration `default:"10m" help:"with --watch, sync everything this often, not just the changed files, to catch changes that were missed (0 always syncs everything)"`
+	Poll           time.Duration `help:"with --watch, look for changes this often instead of relying on file system events, e.g. 2s for network file systems and container mounts"`
+	MaxFiles       int           `hidden:""`
+	NoCompress     bool          `help:"push files uncompressed, even if the config says to compress them"`
+	BWLimit        byteRate      `name:"bw-limit" help:"limit upload bandwidth, in total over all parallel pushes, e.g. 5MB/s"`
+	Rate           float64       `help:"limit how many files are pushed per second, in total over all parallel pushes"`
+	KeepGoing      bool          `short:"k" help:"keep syncing other files when some fail, report the failures at the end, and don't delete"`
+	Yes            bool          `short:"y" help:"with -D, delete however many files are not in the local directory"`
+	MaxDelete      int           `help:"with -D, delete up to this many files; by default, more than 100, or most of the efmrl, needs --yes; with no local files, any delete needs --yes"`
+	NoHooks        bool          `help:"don't run the build, pre_sync and post_sync hooks from the config"`
 
 	rewriteWarn sync.Once
 	quiet       bool             // copied from Context
-	debug       bool             // copied from Context
 	ts          *httptest.Server // copied to Config
+	hashes      *hashCache       // local ETags from earlier syncs
+	deploy      *deployRecorder  // history of this sync, unless dry run
+	compress    *compressor      // if the config says to compress files
+	cli         *CLIContext      // for reporting events and logging
+	bandwidth   *tokenBucket     // bytes pushed, if BWLimit is set
+	rate        *tokenBucket     // files pushed, if Rate is set
+	progress    *syncProgress    // counts for the display and summary
+	failures    *syncFailures    // collected instead of stopping, if KeepGoing
+	changed     []string         // with --watch, the only paths in the efmrl to sync; nil syncs everything
+	remoteFiles int              // on the server, as of the latest full sync
+	pushed      atomic.Int64     // files pushed by the latest sync
 }
 
 type seenMap map[string]*atomic.Pointer[api2.FileInfo]
@@ -53,12 +74,12 @@ func (sync *SyncCmd) Run(ctx *CLIContext) error {
 	if err != nil {
 		return err
 	}
-	msg, err := loggedIn(cfg)
+	msg, err := loggedIn(ctx.stopContext(), cfg)
 	if err != nil {
 		return err
 	}
 	if msg != "" {
-		fmt.Println(msg)
+		fmt.Fprintln(ctx.chatter(), msg)
 		return nil
 	}
 
@@ -66,91 +87,392 @@ func (sync *SyncCmd) Run(ctx *CLIContext) error {
 		return sync.sync(ctx, cfg)
 	}
 
-	watcher, err := fsnotify.NewWatcher()
-	if err != nil {
-		err = fmt.Errorf("cannot watch for changes: %w", err)
+	return sync.watch(ctx, cfg)
+}
+
+func (sync *SyncCmd) sync(ctx *CLIContext, cfg *Config) error {
+	sync.cli = ctx
+	sync.pushed.Store(0)
+	sync.quiet = ctx.Quiet
+	cfg.skipLen = len(cfg.RootDir) + 1 // +1 for '/' separator
+	cfg.ts = sync.ts
+	var err error
+	if !sync.Watch {
+		// watch runs the build itself, when its sources change
+		if err := sync.runHook(ctx, cfg, "build"); err != nil {
+			return err
+		}
+	}
+	if err := sync.runHook(ctx, cfg, "pre_sync"); err != nil {
 		return err
 	}
-	defer func() {
-		err = watcher.Close()
+	sync.progress = newSyncProgress()
+	stopDisplay := func() {}
+	if !ctx.Quiet && !ctx.isJSON() && isTerminal(os.Stderr) {
+		stopDisplay = sync.progress.display(ctx, os.Stderr)
+		defer stopDisplay()
+	}
+	sync.failures = nil
+	if sync.KeepGoing {
+		sync.failures = &syncFailures{}
+	}
+	sync.bandwidth, sync.rate = nil, nil
+	if sync.BWLimit > 0 {
+		sync.bandwidth = newTokenBucket(float64(sync.BWLimit), float64(sync.BWLimit))
+	}
+	if sync.Rate > 0 {
+		sync.rate = newTokenBucket(sync.Rate, 1)
+	}
+	mounts := cfg.mounts()
+	seen := seenMap{}
+	walk := func(mcfg *Config, found func(*workItem) error) error {
+		return walkLocal(mcfg, sync.warnRewrite, found)
+	}
+	if sync.changed != nil {
+		var items map[*Config][]*workItem
+		items, seen, err = sync.changedItems(mounts)
 		if err != nil {
-			log.Printf("error closing watcher: %v", err)
+			return err
 		}
-	}()
-	err = filepath.WalkDir(cfg.RootDir, func(
-		path string,
-		d fs.DirEntry,
-		err error,
-	) error {
+		walk = func(mcfg *Config, found func(*workItem) error) error {
+			for _, item := range items[mcfg] {
+				if err := found(item); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	} else if sync.DeleteOthers || !sync.Force {
+		err = setSeenMap(cfg, ctx, seen, sync.MaxFiles, sync.CrossFS)
 		if err != nil {
 			return err
 		}
-		if !d.IsDir() {
-			return nil
+		sync.remoteFiles = len(seen)
+	}
+
+	if !sync.Force {
+		sync.hashes, err = loadHashCache(cfg, sync.Rehash)
+		if err != nil {
+			return err
 		}
+	}
 
-		err = watcher.Add(path)
+	// a watch sync of just the changed paths isn't the whole deploy, and
+	// rolling back to it would delete everything else
+	sync.deploy = nil
+	if !sync.DryRun && sync.changed == nil {
+		sync.deploy, err = newDeployRecorder(ctx.stopContext(), cfg, sync.hashes)
 		if err != nil {
-			err = fmt.Errorf("watcher cannot open %q: %w", path, err)
 			return err
 		}
+		if sync.deploy != nil {
+			sync.deploy.manifest.DeleteOthers = sync.DeleteOthers
+		}
+	}
+	if cfg.Compress != nil && !sync.NoCompress {
+		sync.compress, err = newCompressor(cfg, sync.hashes)
+		if err != nil {
+			return err
+		}
+	}
 
-		return nil
-	})
+	err = sync.syncDir(mounts, seen, walk)
+	if err == nil && sync.changed == nil {
+		err = sync.compress.prune()
+	}
+	if saveErr := sync.hashes.save(); saveErr != nil && err == nil {
+		err = saveErr
+	}
 
-	again := time.AfterFunc(0, func() {
-		_ = sync.sync(ctx, cfg)
-	})
-watching:
-	for {
-		select {
-		case <-ctx.Context.Done():
-			break watching
-		case err, ok := <-watcher.Errors:
-			log.Printf("watcher error %v ok %v", err, ok)
-			break watching
-		case event, ok := <-watcher.Events:
-			if !ok {
-				break watching
+	var deleted []string
+	pushFailures := len(sync.failures.failures())
+	switch {
+	case err != nil || !sync.DeleteOthers:
+	case pushFailures > 0:
+		// the local copy may not be what was meant to be deployed
+		ctx.logger().Warn(
+			"not deleting other files, since some files failed",
+			"failed", pushFailures,
+		)
+	default:
+		err = sync.guardDeletes(ctx, cfg, seen)
+		if err != nil {
+			break
+		}
+		deleted, err = deleteFromSeenMap(
+			cfg,
+			ctx,
+			seen,
+			sync.DryRun,
+			sync.Parallel,
+			sync.failures,
+		)
+		sync.progress.deleted.Add(int64(len(deleted)))
+		sync.progress.failed.Add(int64(len(sync.failures.failures()) - pushFailures))
+		if err != nil {
+			sync.progress.failed.Add(1)
+		}
+	}
+
+	failures := sync.failures.failures()
+	if err == nil && len(failures) > 0 {
+		err = &exitError{
+			code: exitFailures,
+			err:  fmt.Errorf("%v files failed to sync", len(failures)),
+		}
+	}
+
+	if finishErr := sync.deploy.finish(deleted, err); finishErr != nil && err == nil {
+		err = finishErr
+	}
+
+	// watch shows its own summary when it's done
+	stopDisplay()
+	if !sync.Watch {
+		if showErr := ctx.showSyncSummary(sync.progress.summary()); showErr != nil && err == nil {
+			err = showErr
+		}
+	}
+	if len(failures) > 0 {
+		if showErr := ctx.showFailures(failures); showErr != nil && err == nil {
+			err = showErr
+		}
+	}
+	if err == nil {
+		err = sync.runPostSync(ctx, cfg, sync.progress.summary())
+	}
+
+	return err
+}
+
+// workItem is a local file to be synced
+type workItem struct {
+	path    string // local path, including RootDir
+	dirPath string // directory this index file is rewritten as, if any
+	info    os.FileInfo
+
+	// remotePath, contentType and headers, if set, are used as is, for
+	// files that are not under RootDir (e.g. when rolling back)
+	remotePath  string
+	contentType string
+	headers     http.Header
+
+	// body and bodyInfo, if set, are what is pushed instead of path, e.g.
+	// a compressed copy
+	body     string
+	bodyInfo os.FileInfo
+}
+
+// source returns the file whose bytes are pushed for the item
+func (item *workItem) source() (string, os.FileInfo) {
+	if item.body != "" {
+		return item.body, item.bodyInfo
+	}
+	return item.path, item.info
+}
+
+// pushPath returns the local path that the item is pushed as: its own path,
+// or its directory if it is a rewritten index file.
+func (item *workItem) pushPath(cfg *Config) string {
+	if item.remotePath != "" {
+		return item.remotePath
+	}
+
+	path := item.path
+	if item.dirPath != "" {
+		path = item.dirPath
+	}
+
+	if len(path) <= cfg.skipLen {
+		path += "//"
+	}
+
+	return path
+}
+
+// seenKey returns the key for the item in a seenMap
+func (item *workItem) seenKey(cfg *Config) string {
+	if item.remotePath != "" {
+		return item.remotePath
+	}
+	key := item.pushPath(cfg)[cfg.skipLen:]
+	if cfg.prefix != "" {
+		// a mount's root index is its prefix
+		key = path.Join(cfg.prefix, filepath.ToSlash(key))
+	}
+	return key
+}
+
+// rel returns the item's path relative to the top of the efmrl, before
+// any index rewrite: relative to RootDir, under the mount's prefix
+func (item *workItem) rel(cfg *Config) string {
+	rel := item.path[cfg.skipLen:]
+	if cfg.prefix != "" {
+		rel = filepath.Join(filepath.FromSlash(cfg.prefix), rel)
+	}
+	return rel
+}
+
+// getContentType returns the MIME type the item is pushed with
+func (item *workItem) getContentType(cfg *Config) (string, error) {
+	if item.contentType != "" {
+		return item.contentType, nil
+	}
+	return cfg.contentType(item.path)
+}
+
+// getHeaders returns the headers the item is pushed with
+func (item *workItem) getHeaders(cfg *Config) (http.Header, error) {
+	if item.headers != nil {
+		return item.headers, nil
+	}
+	return cfg.headersFor(item.rel(cfg))
+}
+
+// walkLocal walks cfg.RootDir and calls found for every regular file that
+// is not ignored. Warnings about possible index rewrites go to warn.
+func walkLocal(
+	cfg *Config,
+	warn func(string),
+	found func(*workItem) error,
+) error {
+	return filepath.Walk(
+		cfg.RootDir,
+		func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
 			}
-			if event.Op.Has(fsnotify.Create) {
-				info, err := os.Lstat(event.Name)
-				if err == nil && info.IsDir() {
-					err = watcher.Add(event.Name)
-					if err != nil {
-						log.Printf("watcher cannot add %q: %v", event.Name, err)
-					}
+			if info.IsDir() && cfg.nested[path] {
+				return filepath.SkipDir
+			}
+			if len(path) > cfg.skipLen {
+				skip, err := cfg.ignored(path[cfg.skipLen:], info.IsDir())
+				if err != nil {
+					return err
+				}
+				if skip && info.IsDir() {
+					return filepath.SkipDir
+				}
+				if skip {
+					return nil
 				}
 			}
-			_ = again.Reset(sync.WatchWait)
-		}
+			if !info.Mode().IsRegular() {
+				return nil
+			}
+
+			dirPath, warning := cfg.needsRewrite(path)
+			if warning != "" {
+				warn(warning)
+			}
+
+			return found(&workItem{
+				path:    path,
+				dirPath: dirPath,
+				info:    info,
+			})
+		})
+}
+
+// unchanged reports whether the server already has item, with the same
+// ETag. Either way, the item is marked in seen, so it won't be deleted.
+func (s *SyncCmd) unchanged(
+	cfg *Config,
+	item *workItem,
+	seen seenMap,
+) (bool, error) {
+	key := item.seenKey(cfg)
+	p := seen[key]
+	s.cli.logger().Debug("seen", "key", key, "found", p != nil)
+	if p == nil {
+		return false, nil
 	}
 
-	return err
+	fi := p.Swap(nil)
+	if fi == nil || s.Force {
+		return false, nil
+	}
+
+	srcPath, srcInfo := item.source()
+	etag, same, err := s.hashes.matchETag(srcPath, fi.ETAG, srcInfo)
+	if err != nil {
+		return false, err
+	}
+	if !same {
+		s.cli.logger().Debug("changed", "key", key, "cloud", fi.ETAG, "local", etag)
+	}
+
+	return same, nil
 }
 
-func (sync *SyncCmd) sync(ctx *CLIContext, cfg *Config) error {
-	sync.quiet = ctx.Quiet
-	ctx.Debug = ctx.Debug || sync.Debug
-	sync.debug = ctx.Debug
-	cfg.skipLen = len(cfg.RootDir) + 1 // +1 for '/' separator
-	cfg.ts = sync.ts
-	var err error
-	seen := seenMap{}
-	if sync.DeleteOthers || !sync.Force {
-		err = setSeenMap(cfg, ctx, seen, sync.MaxFiles, sync.CrossFS)
+// warnRewrite shows the first index rewrite warning, unless quiet
+func (s *SyncCmd) warnRewrite(warning string) {
+	if !s.quiet {
+		s.rewriteWarn.Do(func() {
+			fmt.Fprintln(s.cli.chatter(), warning)
+		})
+	}
+}
+
+// syncDir pushes every changed file that walk finds in each of mounts, to
+// the mount's prefix. With Atomic set, HTML files are held back until
+// everything else, in every mount, is up, so pages never refer to assets
+// that aren't there yet. The server has no way to stage a whole deploy and
+// switch over to it, so this is as close as we can get.
+func (s *SyncCmd) syncDir(
+	mounts []*Config,
+	seen seenMap,
+	walk func(cfg *Config, found func(*workItem) error) error,
+) error {
+	last := map[*Config][]*workItem{}
+	for _, cfg := range mounts {
+		err := s.pushItems(cfg, cfg.prefix, seen, func(push func(*workItem) error) error {
+			if !s.Atomic {
+				return walk(cfg, push)
+			}
+			return walk(cfg, func(item *workItem) error {
+				contentType, err := cfg.contentType(item.path)
+				if err != nil {
+					return err
+				}
+				if strings.HasPrefix(contentType, "text/html") {
+					last[cfg] = append(last[cfg], item)
+					return nil
+				}
+				return push(item)
+			})
+		})
 		if err != nil {
 			return err
 		}
 	}
 
-	err = sync.syncDir(cfg, "", seen)
-	if err != nil {
-		return err
+	// the walk isn't over, for the ETA, until the HTML held back is queued
+	var lastHeld *Config
+	for _, cfg := range mounts {
+		if len(last[cfg]) > 0 {
+			lastHeld = cfg
+		}
+	}
+	if lastHeld == nil {
+		s.progress.walkDone()
 	}
 
-	if sync.DeleteOthers {
-		err = deleteFromSeenMap(cfg, ctx, seen, sync.DryRun)
+	for _, cfg := range mounts {
+		if len(last[cfg]) == 0 {
+			continue
+		}
+		err := s.pushItems(cfg, cfg.prefix, seen, func(push func(*workItem) error) error {
+			for _, item := range last[cfg] {
+				if err := push(item); err != nil {
+					return err
+				}
+			}
+			if cfg == lastHeld {
+				s.progress.walkDone()
+			}
+			return nil
+		})
 		if err != nil {
 			return err
 		}
@@ -159,125 +481,57 @@ func (sync *SyncCmd) sync(ctx *CLIContext, cfg *Config) error {
 	return nil
 }
 
-func (s *SyncCmd) syncDir(
+// pushItems runs produce, and pushes the items it gives to push with
+// s.Parallel workers. When the user asks to stop, no more items are
+// started, but pushes already under way are left to finish.
+func (s *SyncCmd) pushItems(
 	cfg *Config,
 	urlPrefix string,
 	seen seenMap,
+	produce func(push func(*workItem) error) error,
 ) error {
-	type workItem struct {
-		path    string
-		dirPath string
-		info    os.FileInfo
+	// one client for all the workers, since getting it may load the
+	// global config into cfg
+	client, err := cfg.getClient()
+	if err != nil {
+		return err
 	}
-
-	path := cfg.RootDir
-
-	g, ctx := errgroup.WithContext(context.Background())
+	stop := s.cli.stopContext()
+	g, ctx := errgroup.WithContext(stop)
+	reqCtx := context.WithoutCancel(stop)
 	items := make(chan *workItem)
 
 	g.Go(func() error {
 		defer close(items)
-		return filepath.Walk(
-			path,
-			func(path string, info os.FileInfo, err error) error {
-				if err != nil {
-					return err
-				}
-				if !info.Mode().IsRegular() {
-					return nil
-				}
-
-				dirPath, warn := cfg.needsRewrite(path)
-				if warn != "" && !s.quiet {
-					s.rewriteWarn.Do(func() {
-						fmt.Println(warn)
-					})
-				}
-
-				item := &workItem{
-					path:    path,
-					dirPath: dirPath,
-					info:    info,
-				}
-
-				select {
-				case items <- item:
-				case <-ctx.Done():
-					return ctx.Err()
-				}
-				return nil
-			})
+		return produce(func(item *workItem) error {
+			select {
+			case items <- item:
+				s.progress.queue(item.info.Size())
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			return nil
+		})
 	})
 
 	for i := 0; i < s.Parallel; i++ {
 		g.Go(func() error {
-			client, err := cfg.getClient()
-			if err != nil {
-				return err
-			}
 			for item := range items {
-				path := item.path
-				if item.dirPath != "" {
-					path = item.dirPath
-				}
-
-				if len(path) <= cfg.skipLen {
-					path += "//"
-				}
-				p := seen[path[cfg.skipLen:]]
-				if s.debug {
-					fmt.Printf("seen %q? %v\n", path[cfg.skipLen:], p != nil)
+				if err := ctx.Err(); err != nil {
+					return err
 				}
-				if p != nil {
-					if !s.Force {
-						fi := p.Load()
-						p.Store(nil)
-						if fi.ETAG[:1] == "\"" {
-							l := len(fi.ETAG)
-							fi.ETAG = fi.ETAG[1 : l-1]
-						}
-						multiPart := etagToMultipart(fi.ETAG)
-						etag, err := etag(item.path, multiPart)
-						if err != nil {
-							return err
-						}
-						if fi.ETAG == etag {
-							continue
-						}
-						if s.debug {
-							fmt.Printf("cloud %q != local %q\n", fi.ETAG, etag)
-						}
+				s.progress.working(i, efmrlPath(item.seenKey(cfg)))
+				err := s.pushItem(reqCtx, cfg, client, urlPrefix, item, seen)
+				s.progress.working(i, "")
+				if err != nil && stop.Err() == nil {
+					s.progress.failed.Add(1)
+					if s.failures.add(efmrlPath(item.seenKey(cfg)), err) {
+						continue
 					}
 				}
-				url := cfg.pathToURL(urlPrefix, path).String()
-
-				contentType, err := cfg.contentType(item.path)
 				if err != nil {
 					return err
 				}
-
-				if !s.quiet {
-					fmt.Printf("PUT %v\n", url)
-				}
-				if s.DryRun {
-					continue
-				}
-
-				err = s.put(
-					client,
-					item.path,
-					item.info,
-					contentType,
-					url,
-					os.Stdout,
-				)
-				if err != nil {
-					return fmt.Errorf(
-						"cannot push file %q to efmrl.com: %w",
-						item.path,
-						err,
-					)
-				}
 			}
 			return nil
 		})
@@ -286,6 +540,111 @@ func (s *SyncCmd) syncDir(
 	return g.Wait()
 }
 
+// pushItem pushes one item, unless the server already has it
+func (s *SyncCmd) pushItem(
+	ctx context.Context,
+	cfg *Config,
+	client *http.Client,
+	urlPrefix string,
+	item *workItem,
+	seen seenMap,
+) error {
+	contentType, err := item.getContentType(cfg)
+	if err != nil {
+		return err
+	}
+	headers, err := item.getHeaders(cfg)
+	if err != nil {
+		return err
+	}
+	err = s.compress.compress(cfg, item, contentType, headers)
+	if err != nil {
+		return err
+	}
+	same, err := s.unchanged(cfg, item, seen)
+	if err != nil {
+		return err
+	}
+	srcPath, srcInfo := item.source()
+	url := cfg.pathToURL(urlPrefix, item.pushPath(cfg)).String()
+
+	if same && !s.NoCheckHeaders && len(cfg.Headers) > 0 {
+		differ, err := headersDiffer(ctx, client, url, headers)
+		if err != nil {
+			return err
+		}
+		if differ {
+			s.cli.logger().Debug("headers differ", "url", url)
+		}
+		same = !differ
+	}
+	event := &fileEvent{
+		Path:   efmrlPath(item.seenKey(cfg)),
+		URL:    url,
+		Bytes:  srcInfo.Size(),
+		DryRun: s.DryRun,
+	}
+	if same {
+		event.Action = eventSkip
+		s.cli.event(event)
+		s.progress.done(event, item.info.Size())
+		return s.deploy.add(
+			srcPath,
+			srcInfo,
+			item.seenKey(cfg),
+			contentType,
+			headers,
+			false,
+		)
+	}
+
+	event.Action = eventPut
+	if s.DryRun {
+		s.cli.event(event)
+		s.progress.done(event, item.info.Size())
+		return nil
+	}
+
+	// a push that hasn't started yet can still be stopped
+	err = s.rate.wait(s.cli.stopContext(), 1)
+	if err != nil {
+		return err
+	}
+	err = s.put(
+		ctx,
+		client,
+		srcPath,
+		srcInfo,
+		contentType,
+		headers,
+		url,
+	)
+	if err != nil {
+		err = fmt.Errorf(
+			"cannot push file %q to efmrl.com: %w",
+			item.path,
+			err,
+		)
+		event.Action = eventError
+		event.Error = err.Error()
+		s.cli.event(event)
+		s.progress.done(event, item.info.Size())
+		return err
+	}
+	s.pushed.Add(1)
+	s.cli.event(event)
+	s.progress.done(event, item.info.Size())
+
+	return s.deploy.add(
+		srcPath,
+		srcInfo,
+		item.seenKey(cfg),
+		contentType,
+		headers,
+		true,
+	)
+}
+
 func setSeenMap(
 	cfg *Config,
 	ctx *CLIContext,
@@ -294,50 +653,36 @@ func setSeenMap(
 	crossFS bool,
 ) error {
 	// get existing files
-	client, err := cfg.getClient()
+	client, err := cfg.apiClient()
 	if err != nil {
 		return err
 	}
 
 	continuation := ""
 	for {
-		s3files := &api2.ListFilesRes{}
-		jres := api2.NewResult(s3files)
-		url := cfg.pathToAPIurl("files")
 		req := &api2.ListFilesReq{
 			Continuation: continuation,
 			MaxFiles:     maxFiles,
 			CrossFS:      crossFS,
 		}
-		res, err := postJSON(client, url, req, jres)
+		s3files, err := client.ListFiles(ctx.stopContext(), req)
 		if err != nil {
 			return fmt.Errorf("cannot list files on server: %w", err)
 		}
 
-		if res.StatusCode != http.StatusOK {
-			return fmt.Errorf(
-				"status %v when listing files from server",
-				res.Status,
-			)
-		}
-
 		// make a list of existing files
 		for pathy, fileInfo := range s3files.Files {
 			if pathy != "" && pathy != "/" {
 				pathy = pathy[1:]
 			}
-			if ctx.Debug {
-				fmt.Printf("adding to seenMap: %q\n", pathy)
-			}
+			ctx.logger().Debug("adding to seenMap", "path", pathy)
 
 			p := atomic.Pointer[api2.FileInfo]{}
 			p.Store(fileInfo)
 			seen[pathy] = &p
 		}
 
-		if ctx.Debug {
-			fmt.Printf("###\ncontinuing with cont %q\n###\n", s3files.Continuation)
-		}
+		ctx.logger().Debug("listed files", "continuation", s3files.Continuation)
 		if s3files.Continuation != "" {
 			continuation = s3files.Continuation
 			continue
@@ -349,91 +694,149 @@ func setSeenMap(
 	return nil
 }
 
+// staleFiles returns the files in seen that weren't synced, and aren't
+// ignored by the mount they belong to, sorted
+func staleFiles(cfg *Config, seen seenMap) ([]string, error) {
+	var stale []string
+	mounts := cfg.mounts()
+	for fname, p := range seen {
+		if p.Load() == nil {
+			continue
+		}
+		mcfg, rel := mountFor(mounts, fname)
+		skip, err := mcfg.ignored(rel, false)
+		if err != nil {
+			return nil, err
+		}
+		if !skip {
+			stale = append(stale, fname)
+		}
+	}
+	sort.Strings(stale)
+
+	return stale, nil
+}
+
+// deleteFromSeenMap deletes the files in seen that weren't synced, with
+// up to parallel requests at once, and returns their names. When the user
+// asks to stop, no more deletes are started, but those under way finish.
 func deleteFromSeenMap(
 	cfg *Config,
 	ctx *CLIContext,
 	seen seenMap,
 	dryRun bool,
-) error {
-	client, err := cfg.getClient()
+	parallel int,
+	failures *syncFailures,
+) ([]string, error) {
+	client, err := cfg.apiClient()
 	if err != nil {
-		return err
+		return nil, err
+	}
+	stale, err := staleFiles(cfg, seen)
+	if err != nil {
+		return nil, err
 	}
 
 	cfgCopy := *cfg
 	cfgCopy.skipLen = 0
 
-	for fname, p := range seen {
-		if p.Load() == nil {
-			continue
-		}
-
-		url := cfgCopy.pathToURL("", fname)
-		if !ctx.Quiet {
-			fmt.Printf("DELETE %v\n", url)
-		}
-		if dryRun {
-			continue
-		}
-
-		req, err := http.NewRequest("DELETE", url.String(), nil)
-		if err != nil {
-			return fmt.Errorf("cannot build delete request: %w", err)
+	var (
+		mu      sync.Mutex
+		deleted []string
+	)
+	stop := ctx.stopContext()
+	reqCtx := context.WithoutCancel(stop)
+	g, gctx := errgroup.WithContext(stop)
+	g.SetLimit(max(parallel, 1))
+	for _, fname := range stale {
+		if gctx.Err() != nil {
+			break
 		}
+		g.Go(func() error {
+			if err := gctx.Err(); err != nil {
+				return err
+			}
 
-		res, err := client.Do(req)
-		if err != nil {
-			return fmt.Errorf("cannot send delete request: %w", err)
-		}
-		defer func() {
-			err = res.Body.Close()
-			if err != nil {
-				log.Printf("error closing input file: %v", err)
+			url := cfgCopy.pathToURL("", fname)
+			event := &fileEvent{
+				Action: eventDelete,
+				Path:   efmrlPath(fname),
+				URL:    url.String(),
+				DryRun: dryRun,
 			}
-		}()
+			if !dryRun {
+				err := client.DeleteFile(reqCtx, fname)
+				if efmrlclient.IsNotFound(err) {
+					// already gone, e.g. a file --watch saw come and go
+					return nil
+				}
+				if err != nil {
+					err = fmt.Errorf("cannot delete %q: %w", fname, err)
+					event.Action = eventError
+					event.Error = err.Error()
+					ctx.event(event)
+					if failures.add(efmrlPath(fname), err) {
+						return nil
+					}
+					return err
+				}
+			}
+			ctx.event(event)
 
-		if res.StatusCode > 299 {
-			return fmt.Errorf("status %v when deleting %q", res.Status, fname)
-		}
+			mu.Lock()
+			defer mu.Unlock()
+			deleted = append(deleted, fname)
+
+			return nil
+		})
+	}
+	err = g.Wait()
+	if err == nil {
+		err = stop.Err()
 	}
+	sort.Strings(deleted)
 
-	return nil
+	return deleted, err
 }
 
 func (s *SyncCmd) put(
+	ctx context.Context,
 	client *http.Client,
 	srcPath string,
 	fileinfo os.FileInfo,
 	contentType string,
+	headers http.Header,
 	urlPath string,
-	out io.Writer,
 ) error {
-	var (
-		src *os.File
-		err error
-	)
-
-	maxRetries := defaultMaxRetries
-
-	defer func() {
-		if src != nil {
-			src.Close()
-		}
-	}()
-DoPut:
-	src, err = os.Open(srcPath)
+	src, err := os.Open(srcPath)
 	if err != nil {
 		return err
 	}
-	req, err := http.NewRequest("PUT", urlPath, src)
+	defer src.Close()
+
+	body := s.body(ctx, src)
+	req, err := http.NewRequestWithContext(ctx, "PUT", urlPath, body)
 	if err != nil {
 		return err
 	}
 	req.Header.Set(contentTypeHeader, contentType)
-	req.Header.Set(cacheControlHeader, defaultCache)
+	for name := range headers {
+		req.Header.Set(name, headers.Get(name))
+	}
 	req.ContentLength = fileinfo.Size()
+	// retries send the file again from the start, so what the last
+	// attempt sent isn't counted twice
 	req.GetBody = func() (io.ReadCloser, error) {
-		return io.NopCloser(src), nil
+		f, err := os.Open(srcPath)
+		if err != nil {
+			return nil, err
+		}
+		s.progress.unsend(body)
+		body = s.body(ctx, f)
+		return struct {
+			io.Reader
+			io.Closer
+		}{body, f}, nil
 	}
 
 	res, err := client.Do(req)
@@ -442,23 +845,14 @@ DoPut:
 	}
 	defer res.Body.Close()
 
-	maxRetries--
-	switch {
-	case res.StatusCode == http.StatusOK:
-	case maxRetries == 0:
-		return fmt.Errorf("too many retries; try again later")
-	case res.StatusCode == http.StatusTooManyRequests:
-		if !s.quiet {
-			fmt.Fprintln(out, "efmrl migrating to dedicated storage; retrying")
-		}
-		src.Close()
-		src = nil
-		time.Sleep(5 * time.Second)
-		goto DoPut
-
-	default:
+	if res.StatusCode != http.StatusOK {
 		return fmt.Errorf("failed: received status %v", res.StatusCode)
 	}
 
 	return nil
 }
+
+// body wraps r, a file being pushed, for the bandwidth limit and progress
+func (s *SyncCmd) body(ctx context.Context, r io.Reader) io.Reader {
+	return s.progress.reader(s.bandwidth.reader(ctx, r))
+}
@@ -0,0 +1,528 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/efmrl/api2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeEfmrl is a server holding files in memory. It answers file listings,
+// and records every PUT and DELETE in order.
+type fakeEfmrl struct {
+	mu      sync.Mutex
+	files   map[string]string      // path, with leading '/', to contents
+	headers map[string]http.Header // path to the headers it was PUT with
+	log     []string               // e.g. "PUT /a.html"
+
+	putHook func()          // if set, called during every PUT
+	deny    map[string]bool // paths that PUT and DELETE are forbidden on
+}
+
+func newFakeEfmrl(files map[string]string) (*fakeEfmrl, *httptest.Server) {
+	fe := &fakeEfmrl{
+		files:   map[string]string{},
+		headers: map[string]http.Header{},
+	}
+	for fname, contents := range files {
+		fe.files["/"+fname] = contents
+	}
+
+	return fe, httptest.NewTLSServer(fe)
+}
+
+func (fe *fakeEfmrl) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fe.mu.Lock()
+	defer fe.mu.Unlock()
+
+	if fe.deny[r.URL.Path] && (r.Method == "PUT" || r.Method == "DELETE") {
+		fe.log = append(fe.log, "DENY "+r.URL.Path)
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	switch r.Method {
+	case "POST":
+		res := &api2.ListFilesRes{Files: map[string]*api2.FileInfo{}}
+		for fname, contents := range fe.files {
+			sum := md5.Sum([]byte(contents))
+			res.Files[fname] = &api2.FileInfo{
+				ETAG:  `"` + hex.EncodeToString(sum[:]) + `"`,
+				Bytes: len(contents),
+			}
+		}
+		_ = json.NewEncoder(w).Encode(api2.NewSuccessAny(res))
+	case "PUT":
+		if fe.putHook != nil {
+			fe.putHook()
+		}
+		body, _ := io.ReadAll(r.Body)
+		fe.files[r.URL.Path] = string(body)
+		fe.headers[r.URL.Path] = r.Header.Clone()
+		fe.log = append(fe.log, "PUT "+r.URL.Path)
+	case "HEAD":
+		if _, ok := fe.files[r.URL.Path]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		for name, values := range fe.headers[r.URL.Path] {
+			w.Header()[name] = values
+		}
+	case "DELETE":
+		delete(fe.files, r.URL.Path)
+		delete(fe.headers, r.URL.Path)
+		fe.log = append(fe.log, "DELETE "+r.URL.Path)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func TestSync(t *testing.T) {
+	goBack, err := cdTmp(t)
+	require.NoError(t, err)
+	defer goBack()
+	cleanup, err := fakeHome(t)
+	require.NoError(t, err)
+	defer cleanup()
+
+	writeTree(t, "site", map[string]string{
+		"index.html":     "<h1>home</h1>",
+		"about.html":     "<h1>about</h1>",
+		"css/site.css":   "body {}",
+		"js/app.js":      "alert(1)",
+		"same.txt":       "unchanged",
+		"skip/me.txt":    "ignored",
+		ignoreFileName:   "skip/\n",
+		"img/logo.svg":   "<svg/>",
+		"docs/guide.txt": "read me",
+	})
+
+	newConfig := func(ts *httptest.Server) *Config {
+		cfg := &Config{
+			Efmrl:        "sync-or-swim",
+			CanonURL:     ts.URL,
+			RootDir:      "site",
+			indexRewrite: map[string]bool{"index.html": true},
+			ts:           ts,
+		}
+		require.NoError(t, cfg.prep())
+		return cfg
+	}
+
+	t.Run("atomic pushes HTML last and deletes after", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		fe, ts := newFakeEfmrl(map[string]string{
+			"same.txt":   "unchanged",
+			"stale.html": "old",
+			"skip/x.txt": "ignored, so kept",
+		})
+		defer ts.Close()
+
+		sync := &SyncCmd{
+			Atomic:       true,
+			DeleteOthers: true,
+			Parallel:     4,
+			ts:           ts,
+		}
+		err := sync.sync(&CLIContext{Quiet: true}, newConfig(ts))
+		require.NoError(err)
+
+		require.Len(fe.log, 7)
+		var sawHTML bool
+		for i, entry := range fe.log {
+			switch entry {
+			case "PUT /", "PUT /about.html":
+				sawHTML = true
+			case "DELETE /stale.html":
+				assert.Equal(len(fe.log)-1, i, "delete comes last")
+			default:
+				assert.Falsef(sawHTML, "%q pushed after HTML", entry)
+			}
+		}
+		assert.NotContains(fe.log, "PUT /same.txt")
+		assert.Contains(fe.files, "/skip/x.txt")
+	})
+	t.Run("header rules", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		fe, ts := newFakeEfmrl(nil)
+		defer ts.Close()
+
+		cfg := newConfig(ts)
+		cfg.Headers = []*headerRule{
+			{Match: "js/", Headers: map[string]string{
+				"Cache-Control": "max-age=31536000, immutable",
+			}},
+			{Match: "*.txt", Headers: map[string]string{
+				"Content-Disposition": "attachment",
+				"X-Robots-Tag":        "noindex",
+			}},
+		}
+		require.NoError(cfg.compileHeaderRules())
+
+		sync := &SyncCmd{Parallel: 2, ts: ts}
+		ctx := &CLIContext{Quiet: true}
+		require.NoError(sync.sync(ctx, cfg))
+
+		js := fe.headers["/js/app.js"]
+		assert.Equal("max-age=31536000, immutable", js.Get("Cache-Control"))
+		txt := fe.headers["/docs/guide.txt"]
+		assert.Equal(defaultCache, txt.Get("Cache-Control"))
+		assert.Equal("attachment", txt.Get("Content-Disposition"))
+		assert.Equal("noindex", txt.Get("X-Robots-Tag"))
+
+		// a header-only change is found by status, and re-pushed by sync
+		cfg.Headers[0].Headers["Cache-Control"] = "max-age=60"
+		report, err := (&StatusCmd{NoCheckHeaders: true}).status(ctx, cfg)
+		require.NoError(err)
+		assert.Empty(report.HeadersDiffer)
+		assert.True(report.HeadersUnchecked)
+
+		report, err = (&StatusCmd{}).status(ctx, cfg)
+		require.NoError(err)
+		assert.Equal([]string{"js/app.js"}, report.HeadersDiffer)
+		assert.False(report.HeadersUnchecked)
+
+		fe.log = nil
+		sync = &SyncCmd{Parallel: 2, NoCheckHeaders: true, ts: ts}
+		require.NoError(sync.sync(ctx, cfg))
+		assert.Empty(fe.log)
+		sync = &SyncCmd{Parallel: 2, ts: ts}
+		require.NoError(sync.sync(ctx, cfg))
+		assert.Equal([]string{"PUT /js/app.js"}, fe.log)
+		assert.Equal("max-age=60", fe.headers["/js/app.js"].Get("Cache-Control"))
+	})
+	t.Run("json events", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		_, ts := newFakeEfmrl(map[string]string{
+			"same.txt":   "unchanged",
+			"stale.html": "old",
+		})
+		defer ts.Close()
+
+		out := &bytes.Buffer{}
+		ctx := &CLIContext{Output: outputJSON, Stdout: out}
+		sync := &SyncCmd{DeleteOthers: true, Parallel: 2, ts: ts}
+		require.NoError(sync.sync(ctx, newConfig(ts)))
+
+		actions := map[string]string{}
+		dec := json.NewDecoder(out)
+		for dec.More() {
+			ev := &fileEvent{}
+			require.NoError(dec.Decode(ev))
+			actions[ev.Path] = ev.Action
+		}
+		assert.Equal(eventPut, actions["/"])
+		assert.Equal(eventPut, actions["/css/site.css"])
+		assert.Equal(eventSkip, actions["/same.txt"])
+		assert.Equal(eventDelete, actions["/stale.html"])
+		assert.NotContains(actions, "/skip/me.txt")
+	})
+	t.Run("summary", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		_, ts := newFakeEfmrl(map[string]string{
+			"same.txt":   "unchanged",
+			"stale.html": "old",
+		})
+		defer ts.Close()
+
+		out := &bytes.Buffer{}
+		ctx := &CLIContext{Output: outputJSON, Stdout: out}
+		sync := &SyncCmd{DeleteOthers: true, Parallel: 2, ts: ts}
+		require.NoError(sync.sync(ctx, newConfig(ts)))
+
+		lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+		summary := &syncSummary{}
+		require.NoError(json.Unmarshal([]byte(lines[len(lines)-1]), summary))
+		assert.Equal("summary", summary.Action)
+		assert.Equal(int64(6), summary.Uploaded)
+		assert.Equal(int64(1), summary.Skipped)
+		assert.Equal(int64(1), summary.Deleted)
+		assert.Equal(int64(0), summary.Failed)
+		assert.Positive(summary.Bytes)
+
+		out.Reset()
+		ctx = &CLIContext{Output: outputTable, Stdout: out}
+		sync = &SyncCmd{Parallel: 2, ts: ts}
+		require.NoError(sync.sync(ctx, newConfig(ts)))
+		assert.Regexp(`^uploaded 0, unchanged 7, deleted 0, failed 0; 0B in \S+\n$`, out.String())
+	})
+	t.Run("keep going", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		fe, ts := newFakeEfmrl(map[string]string{
+			"stale.html": "old",
+			"gone.txt":   "old",
+		})
+		defer ts.Close()
+
+		// without --keep-going, the first failure stops the sync
+		fe.deny = map[string]bool{"/css/site.css": true}
+		ctx := &CLIContext{Quiet: true}
+		sync := &SyncCmd{DeleteOthers: true, Parallel: 1, ts: ts}
+		err := sync.sync(ctx, newConfig(ts))
+		assert.ErrorContains(err, "403")
+		assert.NotContains(fe.log, "PUT /js/app.js")
+
+		// with it, the rest are pushed, but nothing is deleted
+		fe.log = nil
+		out := &bytes.Buffer{}
+		ctx = &CLIContext{Output: outputJSON, Stdout: out}
+		sync = &SyncCmd{DeleteOthers: true, KeepGoing: true, Parallel: 2, ts: ts}
+		err = sync.sync(ctx, newConfig(ts))
+		var exitErr *exitError
+		require.ErrorAs(err, &exitErr)
+		assert.Equal(exitFailures, exitErr.ExitCode())
+		assert.Contains(fe.log, "PUT /js/app.js")
+		assert.Contains(fe.files, "/stale.html")
+
+		lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+		report := &failureReport{}
+		require.NoError(json.Unmarshal([]byte(lines[len(lines)-1]), report))
+		assert.Equal("failures", report.Action)
+		require.Len(report.Failures, 1)
+		assert.Equal("/css/site.css", report.Failures[0].Path)
+		summary := &syncSummary{}
+		require.NoError(json.Unmarshal([]byte(lines[len(lines)-2]), summary))
+		assert.Equal(int64(1), summary.Failed)
+		assert.Equal(int64(0), summary.Deleted)
+
+		// once pushes succeed, failed deletes are collected too
+		fe.deny = map[string]bool{"/gone.txt": true}
+		out.Reset()
+		ctx = &CLIContext{Stdout: out}
+		sync = &SyncCmd{DeleteOthers: true, KeepGoing: true, Parallel: 2, ts: ts}
+		err = sync.sync(ctx, newConfig(ts))
+		require.ErrorAs(err, &exitErr)
+		assert.NotContains(fe.files, "/stale.html")
+		assert.Contains(out.String(), "uploaded 1, unchanged 6, deleted 1, failed 1")
+		assert.Regexp(`1 failed:\n    /gone.txt  cannot delete "gone.txt": .*403`, out.String())
+	})
+	t.Run("parallel deletes", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		stale := map[string]string{}
+		for i := range 40 {
+			stale[fmt.Sprintf("old/%02d.html", i)] = "old"
+		}
+		fe, _ := newFakeEfmrl(stale)
+		var (
+			mu             sync.Mutex
+			inflight, most int
+		)
+		ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == "DELETE" {
+				mu.Lock()
+				inflight++
+				most = max(most, inflight)
+				mu.Unlock()
+				time.Sleep(5 * time.Millisecond)
+				defer func() {
+					mu.Lock()
+					defer mu.Unlock()
+					inflight--
+				}()
+			}
+			fe.ServeHTTP(w, r)
+		}))
+		defer ts.Close()
+
+		sync := &SyncCmd{DeleteOthers: true, Yes: true, Parallel: 4, ts: ts}
+		require.NoError(sync.sync(&CLIContext{Quiet: true}, newConfig(ts)))
+		for fname := range stale {
+			assert.NotContains(fe.files, "/"+fname)
+		}
+		assert.Greater(most, 1)
+		assert.LessOrEqual(most, 4)
+	})
+	t.Run("mass delete guard", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		stale := map[string]string{}
+		for i := range 20 {
+			stale[fmt.Sprintf("old/%02d.html", i)] = "old"
+		}
+		fe, ts := newFakeEfmrl(stale)
+		defer ts.Close()
+
+		// most of the efmrl
+		out := &bytes.Buffer{}
+		ctx := &CLIContext{Stdout: out}
+		sync := &SyncCmd{DeleteOthers: true, Parallel: 2, ts: ts}
+		err := sync.sync(ctx, newConfig(ts))
+		assert.ErrorContains(err, "not deleting 20 files, since that is most of the 20 files")
+		assert.Contains(out.String(), "would delete 20 files:\n    /old/00.html\n")
+		assert.Len(fe.files, 27)
+
+		out.Reset()
+		sync = &SyncCmd{DeleteOthers: true, Parallel: 2, MaxDelete: 19, ts: ts}
+		err = sync.sync(&CLIContext{Quiet: true, Stdout: out}, newConfig(ts))
+		assert.ErrorContains(err, "more than --max-delete 19")
+		assert.Contains(out.String(), "/old/19.html")
+
+		// no local files at all
+		require.NoError(os.MkdirAll("empty", 0777))
+		cfg := newConfig(ts)
+		cfg.RootDir = "empty"
+		out.Reset()
+		ctx = &CLIContext{Output: outputJSON, Stdout: out}
+		sync = &SyncCmd{DeleteOthers: true, Parallel: 2, ts: ts}
+		err = sync.sync(ctx, cfg)
+		assert.ErrorContains(err, "no local files were found")
+		assert.Contains(out.String(), `"action":"delete","path":"/about.html"`)
+		assert.Contains(out.String(), `"dry_run":true`)
+		assert.Len(fe.files, 27)
+
+		// even if --max-delete would allow it
+		sync = &SyncCmd{DeleteOthers: true, Parallel: 2, MaxDelete: 27, ts: ts}
+		err = sync.sync(&CLIContext{Quiet: true, Stdout: out}, cfg)
+		assert.ErrorContains(err, "no local files were found")
+		assert.ErrorContains(err, "or use --yes")
+		assert.Len(fe.files, 27)
+
+		sync = &SyncCmd{DeleteOthers: true, Parallel: 2, Yes: true, ts: ts}
+		require.NoError(sync.sync(&CLIContext{Quiet: true}, cfg))
+		assert.Empty(fe.files)
+	})
+	t.Run("only changed paths", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		writeTree(t, "inc", map[string]string{
+			"index.html":     "<h1>home</h1>",
+			"a.txt":          "a",
+			"b.txt":          "b",
+			"sub/index.html": "<h1>sub</h1>",
+		})
+		fe, ts := newFakeEfmrl(nil)
+		defer ts.Close()
+		cfg := newConfig(ts)
+		cfg.RootDir = "inc"
+		cfg.DeployHistory = 5
+
+		sync := &SyncCmd{DeleteOthers: true, Parallel: 2, ts: ts}
+		require.NoError(sync.sync(&CLIContext{Quiet: true}, cfg))
+		require.Len(fe.files, 4)
+
+		// index.html changes too, but isn't among the changed paths
+		writeTree(t, "inc", map[string]string{
+			"index.html": "<h1>new home</h1>",
+			"a.txt":      "new a",
+			"c.txt":      "c",
+		})
+		require.NoError(os.Remove("inc/b.txt"))
+		require.NoError(os.Remove("inc/sub/index.html"))
+		dir, err := cfg.stateDir()
+		require.NoError(err)
+		deploys, err := loadDeploys(dir)
+		require.NoError(err)
+		require.Len(deploys, 1)
+		fe.log = nil
+		sync.changed = []string{"a.txt", "b.txt", "c.txt", "sub/index.html"}
+		require.NoError(sync.sync(&CLIContext{Quiet: true}, cfg))
+		assert.ElementsMatch([]string{
+			"PUT /a.txt",
+			"PUT /c.txt",
+			"DELETE /b.txt",
+			"DELETE /sub",
+		}, fe.log)
+		assert.Equal("<h1>home</h1>", fe.files["/"])
+
+		// only whole syncs are deploys
+		after, err := loadDeploys(dir)
+		require.NoError(err)
+		assert.Equal(deploys, after)
+	})
+	t.Run("mounts", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		writeTree(t, "dist", map[string]string{
+			"index.html": "<h1>home</h1>",
+			"a.txt":      "a",
+		})
+		writeTree(t, "docsbuild", map[string]string{
+			"index.html": "<h1>docs</h1>",
+			"guide.html": "<h1>guide</h1>",
+		})
+		writeTree(t, "static", map[string]string{
+			"logo.png": "png",
+		})
+		fe, ts := newFakeEfmrl(map[string]string{
+			"old.txt":        "old",
+			"docs/old.html":  "old",
+			"assets/old.css": "old",
+		})
+		defer ts.Close()
+		cfg := newConfig(ts)
+		cfg.RootDir = "dist"
+		cfg.Mounts = []*mountConfig{
+			{Local: "docsbuild", RemotePrefix: "/docs/"},
+			{Local: "static/", RemotePrefix: "assets"},
+		}
+		require.NoError(cfg.checkMounts())
+
+		sync := &SyncCmd{DeleteOthers: true, Yes: true, Parallel: 2, ts: ts}
+		require.NoError(sync.sync(&CLIContext{Quiet: true}, cfg))
+		assert.Equal(map[string]string{
+			"/":                "<h1>home</h1>",
+			"/a.txt":           "a",
+			"/docs":            "<h1>docs</h1>",
+			"/docs/guide.html": "<h1>guide</h1>",
+			"/assets/logo.png": "png",
+		}, fe.files)
+
+		// each mount's stale files are its own
+		writeTree(t, "docsbuild", map[string]string{
+			"guide.html": "<h1>new guide</h1>",
+		})
+		require.NoError(os.Remove("static/logo.png"))
+		fe.log = nil
+		sync.changed = []string{"docs/guide.html", "assets/logo.png"}
+		require.NoError(sync.sync(&CLIContext{Quiet: true}, cfg))
+		assert.ElementsMatch([]string{
+			"PUT /docs/guide.html",
+			"DELETE /assets/logo.png",
+		}, fe.log)
+	})
+	t.Run("stopping lets pushes under way finish", func(t *testing.T) {
+		assert := assert.New(t)
+
+		fe, ts := newFakeEfmrl(nil)
+		defer ts.Close()
+		stopCtx, stop := context.WithCancel(context.Background())
+		defer stop()
+		fe.putHook = stop
+
+		ctx := &CLIContext{Context: stopCtx, Quiet: true}
+		sync := &SyncCmd{Parallel: 1, ts: ts}
+		err := sync.sync(ctx, newConfig(ts))
+		assert.ErrorIs(err, context.Canceled)
+		assert.Len(fe.log, 1)
+		assert.Equal(int64(1), sync.pushed.Load())
+	})
+}
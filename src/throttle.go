@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tokenBucket hands out tokens at rate per second, saving up at most burst
+// of them. One bucket is shared by every worker, so its limit holds in
+// total. A nil *tokenBucket never waits.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate, burst float64) *tokenBucket {
+	return &tokenBucket{
+		rate:   rate,
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+// wait takes n tokens, waiting until they've been earned or ctx is done. It
+// may take more than burst tokens; that just waits longer.
+func (tb *tokenBucket) wait(ctx context.Context, n float64) error {
+	if tb == nil {
+		return nil
+	}
+
+	tb.mu.Lock()
+	now := time.Now()
+	tb.tokens = min(tb.burst, tb.tokens+now.Sub(tb.last).Seconds()*tb.rate)
+	tb.last = now
+	tb.tokens -= n
+	var delay time.Duration
+	if tb.tokens < 0 {
+		delay = time.Duration(-tb.tokens / tb.rate * float64(time.Second))
+	}
+	tb.mu.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// reader returns r, throttled to the bucket's rate in bytes per second
+func (tb *tokenBucket) reader(ctx context.Context, r io.Reader) io.Reader {
+	if tb == nil {
+		return r
+	}
+	return &throttledReader{ctx: ctx, r: r, bucket: tb}
+}
+
+// throttledReader waits for a token per byte read
+type throttledReader struct {
+	ctx    context.Context
+	r      io.Reader
+	bucket *tokenBucket
+}
+
+func (tr *throttledReader) Read(p []byte) (int, error) {
+	// small reads keep the flow smooth, and within the burst
+	if chunk := max(int(tr.bucket.burst), 1); len(p) > chunk {
+		p = p[:chunk]
+	}
+
+	n, err := tr.r.Read(p)
+	if n > 0 {
+		if werr := tr.bucket.wait(tr.ctx, float64(n)); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+// byteRate is a byteSize per second, e.g. "5MB/s"; the "/s" is optional
+type byteRate byteSize
+
+func (br *byteRate) UnmarshalText(text []byte) error {
+	str := strings.TrimSpace(string(text))
+	if len(str) > 2 && strings.EqualFold(str[len(str)-2:], "/s") {
+		str = str[:len(str)-2]
+	}
+
+	var bs byteSize
+	if err := bs.UnmarshalText([]byte(str)); err != nil {
+		return fmt.Errorf("cannot parse %q as a rate", string(text))
+	}
+	*br = byteRate(bs)
+
+	return nil
+}
+
+func (br byteRate) String() string {
+	return byteSize(br).String() + "/s"
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestThrottle(t *testing.T) {
+	t.Run("bucket is shared", func(t *testing.T) {
+		assert := assert.New(t)
+
+		// 10 workers take 100 tokens from a bucket of 1000/s with 200 saved
+		// up, so all of them take about 0.8s
+		tb := newTokenBucket(1000, 200)
+		start := time.Now()
+		var wg sync.WaitGroup
+		for range 10 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				assert.NoError(tb.wait(context.Background(), 100))
+			}()
+		}
+		wg.Wait()
+		elapsed := time.Since(start)
+		assert.GreaterOrEqual(elapsed, 700*time.Millisecond)
+		assert.Less(elapsed, 2*time.Second)
+	})
+
+	t.Run("waiting stops with the context", func(t *testing.T) {
+		assert := assert.New(t)
+
+		tb := newTokenBucket(1, 1)
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		assert.NoError(tb.wait(ctx, 1))
+		assert.ErrorIs(tb.wait(ctx, 1), context.Canceled)
+
+		var none *tokenBucket
+		assert.NoError(none.wait(ctx, 1e9))
+	})
+
+	t.Run("reader", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		data := bytes.Repeat([]byte("efmrl"), 1000)
+		tb := newTokenBucket(10000, 1000)
+		start := time.Now()
+		got, err := io.ReadAll(tb.reader(context.Background(), bytes.NewReader(data)))
+		require.NoError(err)
+		assert.Equal(data, got)
+		assert.GreaterOrEqual(time.Since(start), 350*time.Millisecond)
+
+		var none *tokenBucket
+		r := bytes.NewReader(data)
+		assert.Same(r, none.reader(context.Background(), r))
+	})
+
+	t.Run("byte rates", func(t *testing.T) {
+		assert := assert.New(t)
+
+		for text, want := range map[string]byteRate{
+			"5MB/s":   5 << 20,
+			"5mib/S":  5 << 20,
+			"512K":    512 << 10,
+			"1000/s":  1000,
+			" 2GB/s ": 2 << 30,
+		} {
+			var br byteRate
+			assert.NoError(br.UnmarshalText([]byte(text)), text)
+			assert.Equal(want, br, text)
+		}
+
+		for _, text := range []string{"", "/s", "fast", "-1MB/s"} {
+			var br byteRate
+			assert.Error(br.UnmarshalText([]byte(text)), text)
+		}
+
+		assert.Equal("5MiB/s", byteRate(5<<20).String())
+	})
+}
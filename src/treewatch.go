@@ -0,0 +1,302 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// fileChange is a change seen by a treeWatcher
+type fileChange struct {
+	path string
+	dir  bool // a directory went away, and what was in it can't be listed
+	lost bool // events were lost, so anything may have changed
+}
+
+// treeWatcher watches RootDir, the mounts, and any other roots, for changes
+// to the files under them: with file system events, or by polling. It
+// watches directories that are created, and reports the files in those
+// moved in. If the file system drops events, it watches again from scratch;
+// other errors are logged, and watching goes on.
+type treeWatcher struct {
+	cli     *CLIContext
+	roots   []string          // RootDir and the mounts first; each a file or directory
+	mounts  int               // how many roots are RootDir and the mounts
+	watcher *fsnotify.Watcher // unless polling
+	events  <-chan fsnotify.Event
+	errors  <-chan error
+
+	// changes gets what changed, until the watcher stops
+	changes chan fileChange
+
+	mu   sync.Mutex
+	dirs map[string]bool // being watched
+}
+
+// newTreeWatcher starts watching cfg.RootDir, the mounts' directories and
+// roots, until the user asks to stop. With poll set, it walks them that
+// often instead of asking for events.
+func newTreeWatcher(
+	ctx *CLIContext,
+	cfg *Config,
+	poll time.Duration,
+	roots ...string,
+) (*treeWatcher, error) {
+	tw := &treeWatcher{
+		cli:     ctx,
+		changes: make(chan fileChange),
+		dirs:    map[string]bool{},
+	}
+	for _, mcfg := range cfg.mounts() {
+		tw.roots = append(tw.roots, mcfg.RootDir)
+	}
+	tw.mounts = len(tw.roots)
+	tw.roots = append(tw.roots, roots...)
+	stop := ctx.stopContext()
+
+	if poll > 0 {
+		p, err := newPoller(cfg, poll, roots...)
+		if err != nil {
+			return nil, err
+		}
+		go p.run(stop)
+		tw.events, tw.errors = p.events, p.errors
+		go tw.run(stop)
+		return tw, nil
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		err = fmt.Errorf("cannot watch for changes: %w", err)
+		return nil, err
+	}
+	tw.watcher = watcher
+	tw.events, tw.errors = watcher.Events, watcher.Errors
+	err = tw.watchAll()
+	if err != nil {
+		_ = watcher.Close()
+		return nil, err
+	}
+	go tw.run(stop)
+
+	return tw, nil
+}
+
+// close stops watching
+func (tw *treeWatcher) close() error {
+	if tw.watcher == nil {
+		return nil
+	}
+	return tw.watcher.Close()
+}
+
+// run turns events into changes until stop is done or the events end
+func (tw *treeWatcher) run(stop context.Context) {
+	defer close(tw.changes)
+	for {
+		var changes []fileChange
+		select {
+		case <-stop.Done():
+			return
+		case err, ok := <-tw.errors:
+			if !ok {
+				return
+			}
+			if !errors.Is(err, fsnotify.ErrEventOverflow) {
+				tw.cli.logger().Error("watcher failed", "error", err)
+				continue
+			}
+			tw.cli.logger().Warn("some changes were missed", "error", err)
+			tw.rewatch()
+			changes = []fileChange{{lost: true}}
+		case event, ok := <-tw.events:
+			if !ok {
+				return
+			}
+			changes = tw.handle(event)
+		}
+
+		for _, change := range changes {
+			select {
+			case tw.changes <- change:
+			case <-stop.Done():
+				return
+			}
+		}
+	}
+}
+
+// handle returns the changes that event means
+func (tw *treeWatcher) handle(event fsnotify.Event) []fileChange {
+	if event.Op == fsnotify.Chmod || !isUnder(event.Name, tw.roots...) {
+		// not in a root, but in the directory of a root that is a file
+		return nil
+	}
+
+	info, err := os.Lstat(event.Name)
+	switch {
+	case err == nil && info.IsDir():
+		if !event.Op.Has(fsnotify.Create) || tw.watcher == nil {
+			return nil
+		}
+		changes, err := tw.watchTree(event.Name, true)
+		if err != nil {
+			tw.cli.logger().Warn("watcher cannot add directory", "path", event.Name, "error", err)
+		}
+		return changes
+	case event.Op.Has(fsnotify.Remove) || event.Op.Has(fsnotify.Rename):
+		tw.mu.Lock()
+		wasDir := tw.dirs[event.Name]
+		tw.mu.Unlock()
+		if wasDir {
+			tw.unwatch(event.Name)
+			return []fileChange{{path: event.Name, dir: true}}
+		}
+	}
+
+	return []fileChange{{path: event.Name}}
+}
+
+// watchTree watches root and the directories under it. With list set, it
+// returns the files under it as changes, as when a directory is moved in.
+func (tw *treeWatcher) watchTree(root string, list bool) ([]fileChange, error) {
+	var changes []fileChange
+	err := filepath.WalkDir(root, func(
+		path string,
+		d fs.DirEntry,
+		err error,
+	) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			if list {
+				changes = append(changes, fileChange{path: path})
+			}
+			return nil
+		}
+
+		err = tw.add(path)
+		if err != nil {
+			return err
+		}
+
+		return nil
+	})
+
+	return changes, err
+}
+
+// add watches dir
+func (tw *treeWatcher) add(dir string) error {
+	err := tw.watcher.Add(dir)
+	if err != nil {
+		return fmt.Errorf("watcher cannot open %q: %w", dir, err)
+	}
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	tw.dirs[dir] = true
+
+	return nil
+}
+
+// watchAll watches the roots: directories with watchTree, and files
+// through the directories they are in
+func (tw *treeWatcher) watchAll() error {
+	for i, root := range tw.roots {
+		info, err := os.Stat(root)
+		switch {
+		case err != nil && i >= tw.mounts:
+			return fmt.Errorf("cannot watch %q: %w", root, err)
+		case err == nil && !info.IsDir():
+			err = tw.add(filepath.Dir(root))
+		default:
+			_, err = tw.watchTree(root, false)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// unwatch stops watching dir, and the directories under it, when it is
+// gone; the watcher may have stopped already
+func (tw *treeWatcher) unwatch(dir string) {
+	var gone []string
+	tw.mu.Lock()
+	for path := range tw.dirs {
+		if path == dir || strings.HasPrefix(path, dir+string(filepath.Separator)) {
+			gone = append(gone, path)
+			delete(tw.dirs, path)
+		}
+	}
+	tw.mu.Unlock()
+	for _, path := range gone {
+		_ = tw.watcher.Remove(path)
+	}
+}
+
+// rewatch watches everything again from scratch
+func (tw *treeWatcher) rewatch() {
+	if tw.watcher == nil {
+		return
+	}
+	tw.mu.Lock()
+	all := make([]string, 0, len(tw.dirs))
+	for dir := range tw.dirs {
+		all = append(all, dir)
+	}
+	tw.mu.Unlock()
+	for _, dir := range all {
+		tw.unwatch(dir)
+	}
+
+	err := tw.watchAll()
+	if err != nil {
+		tw.cli.logger().Error("cannot watch for changes", "error", err)
+	}
+}
+
+// rootGone reports whether RootDir or a mount's directory went away, so it
+// isn't watched
+func (tw *treeWatcher) rootGone() bool {
+	if tw.watcher == nil {
+		return false
+	}
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	for _, root := range tw.roots[:tw.mounts] {
+		if !tw.dirs[root] {
+			return true
+		}
+	}
+	return false
+}
+
+// isMount reports whether path is RootDir or a mount's directory
+func (tw *treeWatcher) isMount(path string) bool {
+	return slices.Contains(tw.roots[:tw.mounts], path)
+}
+
+// isUnder reports whether path is, or is under, any of roots
+func isUnder(path string, roots ...string) bool {
+	for _, root := range roots {
+		rel, err := filepath.Rel(root, path)
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return true
+		}
+	}
+
+	return false
+}
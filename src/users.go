@@ -1,14 +1,9 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
-	"net/http"
 	"net/http/httptest"
-	"net/url"
-	"os"
-	"path"
-	"text/tabwriter"
 
 	"github.com/efmrl/api2"
 )
@@ -38,36 +33,25 @@ func (gu *GetUser) Run(ctx *CLIContext) error {
 
 	userID := gu.UserID
 	if userID == "" {
-		userID, err = getCurrentUserID(cfg)
+		userID, err = getCurrentUserID(ctx.stopContext(), cfg)
 		if err != nil {
 			err = fmt.Errorf("cannot get current user ID: %w", err)
 			return err
 		}
 	}
 
-	url := getUserPath(cfg, userID)
-
-	client, err := cfg.getClient()
+	client, err := cfg.apiClient()
 	if err != nil {
 		return err
 	}
 
-	res := &api2.User{}
-	nuRes := api2.NewResult(res)
-	err = getJSON(client, url, nuRes)
+	res, err := client.GetUser(ctx.stopContext(), userID)
 	if err != nil {
 		err = fmt.Errorf("cannot get user data: %w", err)
 		return err
 	}
 
-	out, err := json.MarshalIndent(res, "", "    ")
-	if err != nil {
-		return err
-	}
-
-	fmt.Println(string(out))
-
-	return nil
+	return ctx.showIndented(res)
 }
 
 type CreateUser struct {
@@ -90,32 +74,27 @@ func (cu *CreateUser) Run(ctx *CLIContext) error {
 			Address: cu.Email,
 		},
 	}
-	user := &api2.User{}
 
-	client, err := cfg.getClient()
+	client, err := cfg.apiClient()
 	if err != nil {
 		return err
 	}
-	url := cfg.pathToAPIurl("/users")
 
-	result := api2.NewResult(user)
-	_, err = postJSON(client, url, req, result)
+	user, err := client.CreateUser(ctx.stopContext(), req)
 	if err != nil {
-		return err
-	}
-	if result.Status != api2.StatusSuccess {
-		err = fmt.Errorf("create failed: %v", result.Message)
+		err = fmt.Errorf("create failed: %w", err)
 		return err
 	}
 
-	fmt.Printf("new user ID: %q\n", user.ID)
-
-	return nil
+	return ctx.show(
+		user,
+		fmt.Sprintf("new user ID: %q", user.ID),
+		user.ID,
+	)
 }
 
+// ListUsers lists users; with the global --verbose, with their IDs too
 type ListUsers struct {
-	Verbose bool `short:"v" help:"verbose: list IDs too"`
-
 	ts *httptest.Server
 }
 
@@ -126,19 +105,17 @@ func (lu *ListUsers) Run(ctx *CLIContext) error {
 	}
 	cfg.ts = lu.ts
 
-	client, err := cfg.getClient()
+	client, err := cfg.apiClient()
 	if err != nil {
 		return err
 	}
-	url := cfg.pathToAPIurl("/users")
 
-	users := &api2.ListUsersRes{}
-	err = getJSON(client, url, api2.NewResult(users))
+	users, err := client.ListUsers(ctx.stopContext())
 	if err != nil {
 		return err
 	}
 
-	tw := tabwriter.NewWriter(os.Stdout, 0, 2, 1, ' ', 0)
+	tbl := &table{}
 	for _, user := range users.Users {
 		var emAddr, emID string
 		if len(user.Emails) > 0 {
@@ -146,25 +123,24 @@ func (lu *ListUsers) Run(ctx *CLIContext) error {
 			emID = user.Emails[0].ID
 		}
 		switch {
-		case lu.Verbose:
-			fmt.Fprintf(tw, "%v\t %v\t %v\t %v\t\n", user.ID, user.Name, emAddr, emID)
+		case ctx.Verbose:
+			tbl.add(user.ID, user.Name, emAddr, emID)
 		default:
-			fmt.Fprintf(tw, "%v\t %v\t\n", user.Name, emAddr)
+			tbl.add(user.Name, emAddr)
 		}
 		if len(user.Emails) > 1 {
 			for _, em := range user.Emails[1:] {
 				switch {
-				case lu.Verbose:
-					fmt.Fprintf(tw, "\t\t %v\t %v\t\n", em.Address, em.ID)
+				case ctx.Verbose:
+					tbl.add("", "", em.Address, em.ID)
 				default:
-					fmt.Fprintf(tw, "\t %v\t\n", em.Address)
+					tbl.add("", em.Address)
 				}
 			}
 		}
 	}
 
-	tw.Flush()
-	return nil
+	return ctx.showList(users.Users, tbl)
 }
 
 type UpdateUser struct {
@@ -183,14 +159,13 @@ func (uu *UpdateUser) Run(ctx *CLIContext) error {
 
 	userID := uu.UserID
 	if userID == "" {
-		userID, err = getCurrentUserID(cfg)
+		userID, err = getCurrentUserID(ctx.stopContext(), cfg)
 		if err != nil {
 			err = fmt.Errorf("cannot get current user: %w", err)
 			return err
 		}
 	}
-	url := getUserPath(cfg, userID)
-	client, err := cfg.getClient()
+	client, err := cfg.apiClient()
 	if err != nil {
 		return err
 	}
@@ -198,12 +173,9 @@ func (uu *UpdateUser) Run(ctx *CLIContext) error {
 	req := &api2.User{
 		Name: uu.Name,
 	}
-	resp, err := patchJSON(ctx.Context, client, url, req, nil)
+	err = client.UpdateUser(ctx.stopContext(), userID, req)
 	if err != nil {
-		return err
-	}
-	if resp.StatusCode != http.StatusOK {
-		err = fmt.Errorf("error on update: %v", resp.Status)
+		err = fmt.Errorf("error on update: %w", err)
 		return err
 	}
 
@@ -223,27 +195,14 @@ func (du *DeleteUser) Run(ctx *CLIContext) error {
 	}
 	cfg.ts = du.ts
 
-	url := getUserPath(cfg, du.UserID)
-	client, err := cfg.getClient()
+	client, err := cfg.apiClient()
 	if err != nil {
 		return err
 	}
 
-	req, err := http.NewRequestWithContext(
-		ctx.Context,
-		"DELETE",
-		url.String(),
-		nil,
-	)
+	err = client.DeleteUser(ctx.stopContext(), du.UserID)
 	if err != nil {
-		return err
-	}
-	res, err := client.Do(req)
-	if err != nil {
-		return err
-	}
-	if res.StatusCode >= 400 {
-		err = fmt.Errorf("cannot delete user: %v", res.Status)
+		err = fmt.Errorf("cannot delete user: %w", err)
 		return err
 	}
 
@@ -266,15 +225,13 @@ func (ae *AddEmail) Run(ctx *CLIContext) error {
 
 	userID := ae.UserID
 	if userID == "" {
-		userID, err = getCurrentUserID(cfg)
+		userID, err = getCurrentUserID(ctx.stopContext(), cfg)
 		if err != nil {
 			err = fmt.Errorf("cannot get current user ID: %w", err)
 			return err
 		}
 	}
-	url := getUserPath(cfg, userID)
-	url.Path = path.Join(url.Path, "emails")
-	client, err := cfg.getClient()
+	client, err := cfg.apiClient()
 	if err != nil {
 		return err
 	}
@@ -284,15 +241,9 @@ func (ae *AddEmail) Run(ctx *CLIContext) error {
 			Address: ae.Email,
 		},
 	}
-	email := &api2.Email{}
-	res := api2.NewResult(email)
-
-	_, err = postJSON(client, url, req, res)
+	_, err = client.AddEmail(ctx.stopContext(), userID, req)
 	if err != nil {
-		return err
-	}
-	if res.Status != api2.StatusSuccess {
-		err = fmt.Errorf("cannot add email: %v", res.Message)
+		err = fmt.Errorf("cannot add email: %w", err)
 		return err
 	}
 
@@ -313,46 +264,22 @@ func (de *DeleteEmail) Run(ctx *CLIContext) error {
 	}
 	cfg.ts = de.ts
 
-	url := getUserPath(cfg, de.UserID)
-	client, err := cfg.getClient()
+	client, err := cfg.apiClient()
 	if err != nil {
 		return err
 	}
-	url.Path = path.Join(url.Path, "emails", de.EmailID)
 
-	req, err := http.NewRequestWithContext(
-		ctx.Context,
-		"DELETE",
-		url.String(),
-		nil,
-	)
-	res, err := client.Do(req)
+	err = client.DeleteEmail(ctx.stopContext(), de.UserID, de.EmailID)
 	if err != nil {
+		err = fmt.Errorf("cannot delete email: %w", err)
 		return err
 	}
-	if res.StatusCode >= 400 {
-		err = fmt.Errorf("cannot delete email: %v", res.Status)
-	}
 
 	return nil
 }
 
-func getUserPath(cfg *Config, userID string) *url.URL {
-	path := path.Join("users", userID)
-	url := cfg.pathToAPIurl(path)
-	return url
-}
-
-func getCurrentUserID(cfg *Config) (string, error) {
-	url := cfg.pathToAPIurl("session")
-	client, err := cfg.getClient()
-	if err != nil {
-		return "", err
-	}
-
-	res := &api2.SessionRes{}
-	nsRes := api2.NewResult(res)
-	err = getJSON(client, url, nsRes)
+func getCurrentUserID(ctx context.Context, cfg *Config) (string, error) {
+	res, err := getSession(ctx, cfg)
 	if err != nil {
 		err = fmt.Errorf("cannot get session: %w", err)
 		return "", err
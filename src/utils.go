@@ -1,182 +1,196 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"crypto/md5"
 	"encoding/hex"
-	"encoding/json"
 	"fmt"
 	"io"
-	"log"
-	"net/http"
-	"net/url"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
-
-	"github.com/efmrl/api2"
 )
 
-// getJSON handles making a GET call and unmarshalling the result into your
-// type. The caller is responsible for closing res.Body if there is no err.
-func getJSON(
-	client *http.Client,
-	url *url.URL,
-	target *api2.Response,
-) error {
-	res, err := client.Get(url.String())
-	if err != nil {
-		return err
-	}
-	defer func() {
-		err := res.Body.Close()
-		if err != nil {
-			log.Printf("error on closing JSON result: %v", err)
-		}
-	}()
+var message = `
+You need to log in to proceed. Go here:
 
-	if res.StatusCode != http.StatusOK {
-		return fmt.Errorf("failed: %v", res.Status)
-	}
+%v
+
+click on "get token"
+click on "copy"
+type "efmrl login confirm " and paste the token here
+`
 
-	dec := json.NewDecoder(res.Body)
-	err = dec.Decode(&target)
+func loggedIn(
+	ctx context.Context,
+	cfg *Config,
+) (string, error) {
+	client, err := cfg.apiClient()
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	if target.Status != api2.StatusSuccess {
-		err = fmt.Errorf("%v: %v", target.Status, target.Message)
-		return err
+	session, err := client.Session(ctx)
+
+	if err != nil || session.Confirmed == "" {
+		message := fmt.Sprintf(message, cfg.pathToAdminURL("session"))
+		return message, nil
 	}
 
-	return nil
+	return "", nil
 }
 
-func postJSON(
-	client *http.Client,
-	url *url.URL,
-	args any,
-	target *api2.Response,
-) (*http.Response, error) {
-	reqBody, err := json.Marshal(args)
-	if err != nil {
-		return nil, err
-	}
-	res, err := client.Post(url.String(), "application/json", bytes.NewBuffer(reqBody))
+// writeFileAtomic writes data to a temporary file next to fpath and renames
+// it into place, creating the parent directory if needed, so readers never
+// see a partly written file.
+func writeFileAtomic(fpath string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(fpath)
+	err := os.MkdirAll(dir, 0700)
 	if err != nil {
-		return nil, err
-	}
-	if target == nil {
-		return res, nil
+		return err
 	}
 
-	dec := json.NewDecoder(res.Body)
-	defer res.Body.Close()
-	err = dec.Decode(&target)
+	tmp, err := os.CreateTemp(dir, filepath.Base(fpath)+".*")
 	if err != nil {
-		return nil, err
+		return err
 	}
+	defer os.Remove(tmp.Name())
 
-	return res, nil
-}
-
-func patchJSON(
-	ctx context.Context,
-	client *http.Client,
-	url *url.URL,
-	args any,
-	target *api2.Response,
-) (*http.Response, error) {
-	reqBody, err := json.Marshal(args)
+	_, err = tmp.Write(data)
 	if err != nil {
-		return nil, err
-	}
-	req, err := http.NewRequestWithContext(
-		ctx,
-		"PATCH",
-		url.String(),
-		bytes.NewBuffer(reqBody),
-	)
-	req.Header.Set("Content-Type", "application/json")
-	if err != nil {
-		return nil, err
+		tmp.Close()
+		return err
 	}
-	res, err := client.Do(req)
+	err = tmp.Close()
 	if err != nil {
-		return nil, err
+		return err
 	}
-	defer res.Body.Close()
-	bod, err := io.ReadAll(res.Body)
+	err = os.Chmod(tmp.Name(), perm)
 	if err != nil {
-		return nil, err
-	}
-	if target != nil {
-		err = json.Unmarshal(bod, &target)
-		if err != nil {
-			return nil, err
-		}
+		return err
 	}
 
-	return res, nil
+	return os.Rename(tmp.Name(), fpath)
 }
 
-var message = `
-You need to log in to proceed. Go here:
-
-%v
+// commonPartSizes are the part sizes most uploaders use. They are tried, in
+// order, when the part size of a multipart ETag has to be guessed.
+var commonPartSizes = []int64{
+	8 << 20,   // AWS CLI and SDK default
+	5 << 20,   // S3 minimum
+	16 << 20,  // common tool default
+	15 << 20,  // boto default
+	64 << 20,  // common for large media
+	100 << 20, // rclone and others
+}
 
-click on "get token"
-click on "copy"
-type "efmrl login confirm " and paste the token here
-`
+// partsFor returns how many parts a file of size bytes takes
+func partsFor(size, partSize int64) int {
+	if partSize <= 0 || size <= 0 {
+		return 1
+	}
+	return int((size + partSize - 1) / partSize)
+}
 
-func loggedIn(
-	cfg *Config,
-) (string, error) {
-	url := cfg.pathToAPIurl("session")
-	client, err := cfg.getClient()
+// etag computes the ETag that the server keeps for the file at path. With a
+// partSize of zero, it is the hex MD5 of the whole file. Otherwise it is the
+// S3 multipart ETag: the MD5 of the concatenated binary MD5s of each
+// partSize chunk, followed by "-" and the number of parts.
+func etag(path string, partSize int64) (string, error) {
+	f, err := os.Open(path)
 	if err != nil {
 		return "", err
 	}
+	defer f.Close()
 
-	session := &api2.SessionRes{}
-	err = getJSON(client, url, api2.NewResult(session))
+	if partSize < 1 {
+		h := md5.New()
+		if _, err := io.Copy(h, f); err != nil {
+			return "", fmt.Errorf("cannot read for MD5: %w", err)
+		}
+		return hex.EncodeToString(h.Sum(nil)), nil
+	}
 
-	if err != nil || session.Confirmed == "" {
-		message := fmt.Sprintf(message, cfg.pathToAdminURL("session"))
-		return message, nil
+	metaHash := md5.New()
+	parts := 0
+	for {
+		h := md5.New()
+		n, err := io.CopyN(h, f, partSize)
+		if err != nil && err != io.EOF {
+			return "", fmt.Errorf("cannot read for MD5: %w", err)
+		}
+		if n == 0 && parts > 0 {
+			break
+		}
+		metaHash.Write(h.Sum(nil))
+		parts++
+		if n < partSize {
+			break
+		}
 	}
 
-	return "", nil
+	return fmt.Sprintf("%x-%v", metaHash.Sum(nil), parts), nil
 }
 
-func etag(path string, parts int) (string, error) {
-	f, err := os.Open(path)
-	if err != nil {
-		return "", err
+// matchETagFunc computes the ETag of the local file at path, with hash, in
+// the same form as remote, which is an ETag reported by the server, and
+// reports whether they are equal. For multipart ETags the part size is not
+// recorded, so every candidate that gives the right number of parts for size
+// bytes is tried: first commonPartSizes, and then the smallest whole number
+// of MiB that works.
+func matchETagFunc(
+	hash func(path string, partSize int64) (string, error),
+	path string,
+	remote string,
+	size int64,
+) (string, bool, error) {
+	remote = strings.Trim(remote, `"`)
+	parts := etagToMultipart(remote)
+	if parts < 1 {
+		local, err := hash(path, 0)
+		if err != nil {
+			return "", false, err
+		}
+		return local, local == remote, nil
 	}
-	defer f.Close()
 
-	h := md5.New()
-	if _, err := io.Copy(h, f); err != nil {
-		return "", fmt.Errorf("cannot read for MD5: %w", err)
-	}
-	md5bytes := h.Sum(nil)
-	if parts < 1 {
-		return hex.EncodeToString(md5bytes), nil
+	candidates := append([]int64{}, commonPartSizes...)
+	inferred := (size + int64(parts) - 1) / int64(parts)
+	inferred = (inferred + 1<<20 - 1) &^ (1<<20 - 1)
+	candidates = append(candidates, inferred)
+
+	var local string
+	tried := map[int64]bool{}
+	for _, partSize := range candidates {
+		if partSize <= 0 || tried[partSize] {
+			continue
+		}
+		tried[partSize] = true
+		if partsFor(size, partSize) != parts {
+			continue
+		}
+
+		var err error
+		local, err = hash(path, partSize)
+		if err != nil {
+			return "", false, err
+		}
+		if local == remote {
+			return local, true, nil
+		}
 	}
 
-	metaHash := &bytes.Buffer{}
-	metaHash.Write(md5bytes)
-	metaHash = bytes.NewBuffer(metaHash.Bytes())
-	md5Final := md5.New()
-	if _, err := io.Copy(md5Final, metaHash); err != nil {
-		return "", fmt.Errorf("cannot read metahash: %w", err)
+	if local == "" {
+		// no part size could give that many parts; the file has changed
+		var err error
+		local, err = hash(path, 0)
+		if err != nil {
+			return "", false, err
+		}
 	}
-	finalBytes := md5Final.Sum(nil)
-	return fmt.Sprintf("%x-%v", finalBytes, parts), nil
+
+	return local, false, nil
 }
 
 func etagToMultipart(etag string) int {
@@ -191,3 +205,55 @@ func etagToMultipart(etag string) int {
 
 	return parts
 }
+
+// byteSize is a count of bytes that can be written with a unit suffix, e.g.
+// "64MB" or "5MiB", on the command line or in the config file. As with the
+// AWS tools, "MB" and "MiB" both mean 2^20 bytes.
+type byteSize int64
+
+var byteUnits = []struct {
+	suffix string
+	shift  uint
+}{
+	{"KIB", 10}, {"MIB", 20}, {"GIB", 30},
+	{"KB", 10}, {"MB", 20}, {"GB", 30},
+	{"K", 10}, {"M", 20}, {"G", 30},
+	{"B", 0},
+}
+
+func (bs *byteSize) UnmarshalText(text []byte) error {
+	str := strings.ToUpper(strings.TrimSpace(string(text)))
+	var shift uint
+	for _, unit := range byteUnits {
+		if strings.HasSuffix(str, unit.suffix) {
+			str = strings.TrimSpace(strings.TrimSuffix(str, unit.suffix))
+			shift = unit.shift
+			break
+		}
+	}
+
+	val, err := strconv.ParseFloat(str, 64)
+	if err != nil || val < 0 {
+		return fmt.Errorf("cannot parse %q as a size", string(text))
+	}
+	*bs = byteSize(val * float64(int64(1)<<shift))
+
+	return nil
+}
+
+// MarshalText writes bs with a unit, so that a saved config reads back
+func (bs byteSize) MarshalText() ([]byte, error) {
+	return []byte(bs.String()), nil
+}
+
+func (bs byteSize) String() string {
+	switch {
+	case bs >= 1<<30 && bs%(1<<30) == 0:
+		return fmt.Sprintf("%vGiB", int64(bs)>>30)
+	case bs >= 1<<20 && bs%(1<<20) == 0:
+		return fmt.Sprintf("%vMiB", int64(bs)>>20)
+	case bs >= 1<<10 && bs%(1<<10) == 0:
+		return fmt.Sprintf("%vKiB", int64(bs)>>10)
+	}
+	return fmt.Sprintf("%vB", int64(bs))
+}
@@ -2,13 +2,16 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/efmrl/api2"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func fakeHome(t *testing.T) (func(), error) {
@@ -52,3 +55,107 @@ func returnJSONSuccessAny(res any) *httptest.Server {
 
 	return httptest.NewTLSServer(http.HandlerFunc(f))
 }
+
+func TestByteSize(t *testing.T) {
+	assert := assert.New(t)
+
+	var cases = []struct {
+		text string
+		size byteSize
+	}{
+		{"0", 0},
+		{"1024", 1024},
+		{"5MiB", 5 << 20},
+		{"64MB", 64 << 20},
+		{"1.5k", 1536},
+		{"2 GB", 2 << 30},
+		{"10b", 10},
+	}
+	for _, c := range cases {
+		var bs byteSize
+		err := bs.UnmarshalText([]byte(c.text))
+		assert.NoErrorf(err, "case %#v", c)
+		assert.Equalf(c.size, bs, "case %#v", c)
+	}
+
+	var bs byteSize
+	assert.Error(bs.UnmarshalText([]byte("lots")))
+	assert.Error(bs.UnmarshalText([]byte("-5MB")))
+	assert.Equal("64MiB", byteSize(64<<20).String())
+}
+
+func TestETag(t *testing.T) {
+	dir := t.TempDir()
+	writeFile := func(t *testing.T, name string, data []byte) string {
+		fpath := filepath.Join(dir, name)
+		require.NoError(t, os.WriteFile(fpath, data, 0666))
+		return fpath
+	}
+
+	t.Run("multipart test vectors", func(t *testing.T) {
+		assert := assert.New(t)
+
+		var cases = []struct {
+			data      string
+			partSize  int64
+			wantETag  string
+			wantParts int
+		}{
+			{"abc", 0, "900150983cd24fb0d6963f7d28e17f72", 0},
+			{"abc", 4, "af5da9f45af7a300e3aded972f8ff687-1", 1},
+			{"abcdefghijkl", 0, "9fc9d606912030dca86582ed62595cf7", 0},
+			{"abcdefghijkl", 4, "17ca064a842163311e72510a0a5e810c-3", 3},
+			{"abcdefghijklm", 0, "22aebdd14e72f6b379476a146347d546", 0},
+			{"abcdefghijklm", 4, "e08e9d8c23c981f294cc5a2bc812a6c0-4", 4},
+		}
+		for i, c := range cases {
+			fpath := writeFile(t, fmt.Sprintf("vector-%v", i), []byte(c.data))
+			got, err := etag(fpath, c.partSize)
+			assert.NoError(err)
+			assert.Equalf(c.wantETag, got, "case %#v", c)
+			assert.Equal(c.wantParts, etagToMultipart(got))
+		}
+	})
+
+	t.Run("matchETagFunc finds the part size", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		small := writeFile(t, "small", []byte("abcdefghijklm"))
+		local, same, err := matchETagFunc(etag, small, `"22aebdd14e72f6b379476a146347d546"`, 13)
+		assert.NoError(err)
+		assert.True(same)
+		assert.Equal("22aebdd14e72f6b379476a146347d546", local)
+
+		_, same, err = matchETagFunc(etag, small, "e08e9d8c23c981f294cc5a2bc812a6c0-4", 13)
+		assert.NoError(err)
+		assert.False(same, "part size 4 is neither common nor inferred")
+
+		// a common part size is found
+		data := make([]byte, 8<<20+1)
+		for i := range data {
+			data[i] = byte(i % 253)
+		}
+		big := writeFile(t, "big", data)
+		bigRemote, err := etag(big, 8<<20)
+		require.NoError(err)
+		_, same, err = matchETagFunc(etag, big, bigRemote, int64(len(data)))
+		assert.NoError(err)
+		assert.True(same)
+
+		// an uncommon part size is inferred from the size and part count
+		odd := writeFile(t, "odd", data[:5<<19])
+		remote, err := etag(odd, 1<<20)
+		require.NoError(err)
+		_, same, err = matchETagFunc(etag, odd, remote, 5<<19)
+		assert.NoError(err)
+		assert.True(same)
+
+		// a changed file does not match
+		data[0]++
+		require.NoError(os.WriteFile(big, data, 0666))
+		_, same, err = matchETagFunc(etag, big, bigRemote, int64(len(data)))
+		assert.NoError(err)
+		assert.False(same)
+	})
+}
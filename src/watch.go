@@ -0,0 +1,258 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/efmrl/api2"
+)
+
+// watchSummary is shown when watch mode ends
+type watchSummary struct {
+	Syncs       int      `json:"syncs"`
+	Pushed      int64    `json:"pushed"`
+	Interrupted bool     `json:"interrupted"` // the last sync was cut short
+	NotPushed   []string `json:"not_pushed"`  // changed since the last sync
+}
+
+// watch syncs, then syncs just the files under RootDir and the mounts that
+// change, until the user asks to stop. Every s.Reconcile, and after a
+// directory goes away with -D or events were lost, it syncs everything
+// again, in case some change was missed. A sync under way when the user
+// asks to stop finishes the uploads it has started; then a summary of what
+// was and was not pushed is shown. The build hook runs first, and again
+// whenever its sources change.
+func (s *SyncCmd) watch(ctx *CLIContext, cfg *Config) error {
+	// the first build runs before watching starts, so that what it writes
+	// isn't synced twice
+	if err := s.runHook(ctx, cfg, "build"); err != nil {
+		return err
+	}
+	mounts := cfg.mounts()
+	var sources []string
+	if cfg.Hooks != nil && cfg.Hooks.Build != "" && !s.NoHooks {
+		for _, source := range cfg.Hooks.Sources {
+			sources = append(sources, filepath.Clean(source))
+		}
+	}
+
+	tw, err := newTreeWatcher(ctx, cfg, s.Poll, sources...)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err := tw.close()
+		if err != nil {
+			ctx.logger().Warn("cannot close watcher", "error", err)
+		}
+	}()
+
+	stop := ctx.stopContext()
+	var (
+		running  sync.Mutex // held while a sync runs
+		mu       sync.Mutex // guards the rest
+		pending  = map[string]bool{}
+		fullNext = true  // sync everything next time
+		build    = false // run the build first next time
+		summary  = &watchSummary{}
+	)
+	runSync := func() {
+		running.Lock()
+		defer running.Unlock()
+		if stop.Err() != nil {
+			return
+		}
+
+		mu.Lock()
+		rebuild := build
+		build = false
+		mu.Unlock()
+		if rebuild {
+			if err := s.runHook(ctx, cfg, "build"); err != nil {
+				ctx.logger().Error("build failed", "error", err)
+				return
+			}
+		}
+
+		mu.Lock()
+		batch := maps.Clone(pending)
+		clear(pending)
+		full := fullNext || s.Reconcile <= 0
+		fullNext = false
+		mu.Unlock()
+
+		if full && tw.rootGone() {
+			// RootDir or a mount went away, and may be back
+			tw.rewatch()
+		}
+
+		s.changed = nil
+		if !full {
+			if len(batch) == 0 {
+				return
+			}
+			s.changed = make([]string, 0, len(batch))
+			for path := range batch {
+				s.changed = append(s.changed, path)
+			}
+			sort.Strings(s.changed)
+		}
+		err := s.sync(ctx, cfg)
+
+		mu.Lock()
+		defer mu.Unlock()
+		summary.Syncs++
+		summary.Pushed += s.pushed.Load()
+		summary.Interrupted = stop.Err() != nil
+		if err != nil {
+			if !summary.Interrupted {
+				ctx.logger().Error("sync failed", "error", err)
+			}
+			for path := range batch {
+				pending[path] = true
+			}
+			fullNext = fullNext || full
+		}
+	}
+
+	var reconcile <-chan time.Time
+	if s.Reconcile > 0 {
+		ticker := time.NewTicker(s.Reconcile)
+		defer ticker.Stop()
+		reconcile = ticker.C
+	}
+
+	again := time.AfterFunc(0, runSync)
+watching:
+	for {
+		select {
+		case <-stop.Done():
+			break watching
+		case <-reconcile:
+			mu.Lock()
+			fullNext = true
+			mu.Unlock()
+			_ = again.Reset(0)
+		case change, ok := <-tw.changes:
+			if !ok {
+				break watching
+			}
+			mu.Lock()
+			switch {
+			case change.lost:
+				fullNext = true
+				build = build || len(sources) > 0
+			case len(sources) > 0 && isUnder(change.path, sources...):
+				build = true
+			case change.dir:
+				// what was in it is found by syncing everything
+				fullNext = fullNext || s.DeleteOthers
+				if tw.isMount(change.path) {
+					ctx.logger().Warn("the directory is gone; watching it again at the next full sync", "path", change.path)
+				}
+			default:
+				s.queueChange(mounts, change.path, pending)
+			}
+			mu.Unlock()
+			_ = again.Reset(s.WatchWait)
+		}
+	}
+
+	// let a sync under way drain before summing up
+	again.Stop()
+	running.Lock()
+	defer running.Unlock()
+
+	mu.Lock()
+	defer mu.Unlock()
+	for path := range pending {
+		summary.NotPushed = append(summary.NotPushed, path)
+	}
+	sort.Strings(summary.NotPushed)
+
+	return s.showSummary(ctx, summary)
+}
+
+// queueChange adds file, under one of mounts, to pending as its path in
+// the efmrl, unless it is ignored
+func (s *SyncCmd) queueChange(mounts []*Config, file string, pending map[string]bool) {
+	cfg := localMount(mounts, file)
+	if cfg == nil {
+		return
+	}
+	rel, err := filepath.Rel(cfg.RootDir, file)
+	if err != nil {
+		return
+	}
+	rel = filepath.ToSlash(rel)
+	if skip, _ := cfg.ignored(rel, false); skip {
+		return
+	}
+
+	pending[path.Join(cfg.prefix, rel)] = true
+}
+
+// changedItems sorts s.changed into the files to push, by mount, and a
+// seenMap of those that are gone, which -D deletes
+func (s *SyncCmd) changedItems(mounts []*Config) (map[*Config][]*workItem, seenMap, error) {
+	items := map[*Config][]*workItem{}
+	gone := seenMap{}
+	for _, key := range s.changed {
+		cfg, rel := mountFor(mounts, key)
+		path := filepath.Join(cfg.RootDir, filepath.FromSlash(rel))
+		info, err := os.Lstat(path)
+		switch {
+		case os.IsNotExist(err):
+			dirPath, _ := cfg.needsRewrite(path)
+			item := &workItem{path: path, dirPath: dirPath}
+			p := &atomic.Pointer[api2.FileInfo]{}
+			p.Store(&api2.FileInfo{})
+			gone[item.seenKey(cfg)] = p
+		case err != nil:
+			return nil, nil, err
+		case info.Mode().IsRegular():
+			dirPath, warning := cfg.needsRewrite(path)
+			if warning != "" {
+				s.warnRewrite(warning)
+			}
+			items[cfg] = append(items[cfg], &workItem{
+				path:    path,
+				dirPath: dirPath,
+				info:    info,
+			})
+		}
+	}
+
+	return items, gone, nil
+}
+
+// showSummary shows what a watch did and did not push
+func (s *SyncCmd) showSummary(ctx *CLIContext, summary *watchSummary) error {
+	if ctx.isJSON() {
+		if summary.NotPushed == nil {
+			summary.NotPushed = []string{}
+		}
+		return ctx.writeJSON(summary)
+	}
+
+	out := ctx.stdout()
+	fmt.Fprintf(out, "%v syncs, %v files pushed\n", summary.Syncs, summary.Pushed)
+	if summary.Interrupted {
+		fmt.Fprintln(out, "the last sync was interrupted; files it had not reached may be out of date")
+	}
+	if len(summary.NotPushed) > 0 {
+		fmt.Fprintf(out, "changed but not pushed (%v):\n", len(summary.NotPushed))
+		for _, path := range summary.NotPushed {
+			fmt.Fprintf(out, "    %v\n", path)
+		}
+	}
+
+	return nil
+}